@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"postpath/config"
+	"postpath/database"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const backupUsage = `usage: linuxBuild backup <command>
+
+  now                take a snapshot of the database
+  list               list snapshots, newest first
+  restore <snapshot> replace the database with a snapshot; stop the server first`
+
+// Runs a backup subcommand and returns the process exit code
+func runBackup(ctx context.Context, cfg config.Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, backupUsage)
+		return 2
+	}
+	if database.IsPostgres(cfg.DBPath) {
+		fmt.Fprintln(os.Stderr, "backup: db_path is a PostgreSQL database; back it up with pg_dump")
+		return 1
+	}
+
+	var err error
+	switch {
+	case args[0] == "now" && len(args) == 1:
+		err = backupNow(ctx, cfg)
+	case args[0] == "list" && len(args) == 1:
+		err = listBackups(cfg)
+	case args[0] == "restore" && len(args) == 2:
+		err = restoreBackup(ctx, cfg, args[1])
+	default:
+		fmt.Fprintln(os.Stderr, backupUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "backup:", err)
+		return 1
+	}
+	return 0
+}
+
+func backupNow(ctx context.Context, cfg config.Config) error {
+	// Opening a missing file would create an empty database to back up
+	if _, err := os.Stat(cfg.DBPath); err != nil {
+		return err
+	}
+	if err := database.Open(cfg.DBPath, cfg.DBTimeout.Duration); err != nil {
+		return err
+	}
+	defer database.Close()
+
+	snapshot, err := database.Backup(ctx, cfg.BackupDir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s (%d bytes)\n", snapshot.Path, snapshot.Size)
+
+	removed, err := database.PruneBackups(cfg.BackupDir, cfg.BackupKeep)
+	for _, old := range removed {
+		fmt.Println("removed", old.Path)
+	}
+	return err
+}
+
+func listBackups(cfg config.Config) error {
+	snapshots, err := database.ListBackups(cfg.BackupDir)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		fmt.Println("no snapshots in", cfg.BackupDir)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tTAKEN\tSIZE")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", snapshot.Name, snapshot.Time.Format(time.RFC3339), snapshot.Size)
+	}
+	return w.Flush()
+}
+
+// Restores a snapshot named as listed, or given by path
+func restoreBackup(ctx context.Context, cfg config.Config, snapshot string) error {
+	if serverRunning(cfg.ListenAddr) {
+		return fmt.Errorf("the server is running on %s; stop it before restoring", cfg.ListenAddr)
+	}
+	path := snapshot
+	if !strings.ContainsRune(snapshot, filepath.Separator) {
+		path = filepath.Join(cfg.BackupDir, snapshot)
+	}
+	if err := database.RestoreBackup(ctx, path, cfg.DBPath); err != nil {
+		return err
+	}
+	fmt.Printf("restored %s to %s; the previous database was kept as %s.pre-restore\n", path, cfg.DBPath, cfg.DBPath)
+	return nil
+}
+
+// Reports whether a server answers on listenAddr, so a restore cannot pull
+// the database out from under it
+func serverRunning(listenAddr string) bool {
+	url, err := localURL(listenAddr, "/healthz")
+	if err != nil {
+		return false
+	}
+	client := http.Client{Timeout: time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
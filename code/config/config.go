@@ -0,0 +1,283 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where the config file is read from unless POSTPATH_CONFIG names another
+const DefaultPath = "./local/config.json"
+
+// Settings that can be changed without a rebuild. Each one is read from the
+// JSON config file and can then be overridden by a POSTPATH_* environment
+// variable, e.g. POSTPATH_MAX_POST_LENGTH=1000.
+type Config struct {
+	ListenAddr string `json:"listen_addr"`
+	// Serves /metrics separately from the site; empty turns metrics off
+	MetricsAddr string `json:"metrics_addr"`
+	// A SQLite file, or a postgres:// URL to use PostgreSQL
+	DBPath    string `json:"db_path"`
+	UploadDir string `json:"upload_dir"`
+	// Where database snapshots are written
+	BackupDir string `json:"backup_dir"`
+	// "text" or "json"
+	LogFormat string `json:"log_format"`
+	// "debug", "info", "warn" or "error"
+	LogLevel string `json:"log_level"`
+	// "none", "otlp" to send traces to a collector, or "memory" to keep
+	// recent spans in the process, served at /debug/traces on MetricsAddr
+	TraceExporter string `json:"trace_exporter"`
+	// OTLP/HTTP collector URL, e.g. http://collector:4318
+	TraceEndpoint string `json:"trace_endpoint"`
+	// Share of requests traced, from 0 to 1
+	TraceSampleRatio float64 `json:"trace_sample_ratio"`
+
+	// Longest post, reply or page description in characters
+	MaxPostLength int `json:"max_post_length"`
+	// Posts loaded at a time in the feed
+	PageSize int `json:"page_size"`
+	// Largest image upload in megabytes
+	MaxUploadMB int `json:"max_upload_mb"`
+	// Free space below which the server reports itself not ready
+	MinFreeDiskMB int `json:"min_free_disk_mb"`
+	// Snapshots kept; older ones are deleted after each backup
+	BackupKeep int `json:"backup_keep"`
+
+	SessionLifetime Duration `json:"session_lifetime"`
+	DBTimeout       Duration `json:"db_timeout"`
+	ReadTimeout     Duration `json:"read_timeout"`
+	WriteTimeout    Duration `json:"write_timeout"`
+	IdleTimeout     Duration `json:"idle_timeout"`
+	// Time in-flight requests get to finish once the server is told to stop
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// Time between database snapshots; 0 turns scheduled backups off
+	BackupInterval Duration `json:"backup_interval"`
+
+	Features Features `json:"features"`
+}
+
+// Features that can be switched off
+type Features struct {
+	Registration bool `json:"registration"`
+	Uploads      bool `json:"uploads"`
+	LinkPreviews bool `json:"link_previews"`
+}
+
+// A time.Duration written as a string such as "30s" or "24h"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func Default() Config {
+	return Config{
+		ListenAddr:       ":8080",
+		MetricsAddr:      ":9090",
+		DBPath:           "./local/postpath.db",
+		UploadDir:        "./local/uploads",
+		BackupDir:        "./local/backups",
+		LogFormat:        "text",
+		LogLevel:         "info",
+		TraceExporter:    "none",
+		TraceSampleRatio: 1,
+		MaxPostLength:    500,
+		PageSize:         20,
+		MaxUploadMB:      5,
+		MinFreeDiskMB:    100,
+		BackupKeep:       7,
+		SessionLifetime:  Duration{24 * time.Hour},
+		DBTimeout:        Duration{5 * time.Second},
+		ReadTimeout:      Duration{15 * time.Second},
+		WriteTimeout:     Duration{30 * time.Second},
+		IdleTimeout:      Duration{2 * time.Minute},
+		ShutdownTimeout:  Duration{15 * time.Second},
+		BackupInterval:   Duration{24 * time.Hour},
+		Features: Features{
+			Registration: true,
+			Uploads:      true,
+			LinkPreviews: true,
+		},
+	}
+}
+
+// Loads the defaults, then the config file if it exists, then the environment
+func Load() (Config, error) {
+	cfg := Default()
+
+	path := os.Getenv("POSTPATH_CONFIG")
+	if path == "" {
+		path = DefaultPath
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !(errors.Is(err, fs.ErrNotExist) && os.Getenv("POSTPATH_CONFIG") == "") {
+		return cfg, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	texts := map[string]*string{
+		"POSTPATH_LISTEN_ADDR":    &c.ListenAddr,
+		"POSTPATH_METRICS_ADDR":   &c.MetricsAddr,
+		"POSTPATH_DB_PATH":        &c.DBPath,
+		"POSTPATH_UPLOAD_DIR":     &c.UploadDir,
+		"POSTPATH_BACKUP_DIR":     &c.BackupDir,
+		"POSTPATH_LOG_FORMAT":     &c.LogFormat,
+		"POSTPATH_LOG_LEVEL":      &c.LogLevel,
+		"POSTPATH_TRACE_EXPORTER": &c.TraceExporter,
+		"POSTPATH_TRACE_ENDPOINT": &c.TraceEndpoint,
+	}
+	ints := map[string]*int{
+		"POSTPATH_MAX_POST_LENGTH":  &c.MaxPostLength,
+		"POSTPATH_PAGE_SIZE":        &c.PageSize,
+		"POSTPATH_MAX_UPLOAD_MB":    &c.MaxUploadMB,
+		"POSTPATH_MIN_FREE_DISK_MB": &c.MinFreeDiskMB,
+		"POSTPATH_BACKUP_KEEP":      &c.BackupKeep,
+	}
+	floats := map[string]*float64{
+		"POSTPATH_TRACE_SAMPLE_RATIO": &c.TraceSampleRatio,
+	}
+	durations := map[string]*Duration{
+		"POSTPATH_SESSION_LIFETIME": &c.SessionLifetime,
+		"POSTPATH_DB_TIMEOUT":       &c.DBTimeout,
+		"POSTPATH_READ_TIMEOUT":     &c.ReadTimeout,
+		"POSTPATH_WRITE_TIMEOUT":    &c.WriteTimeout,
+		"POSTPATH_IDLE_TIMEOUT":     &c.IdleTimeout,
+		"POSTPATH_SHUTDOWN_TIMEOUT": &c.ShutdownTimeout,
+		"POSTPATH_BACKUP_INTERVAL":  &c.BackupInterval,
+	}
+	bools := map[string]*bool{
+		"POSTPATH_FEATURE_REGISTRATION":  &c.Features.Registration,
+		"POSTPATH_FEATURE_UPLOADS":       &c.Features.Uploads,
+		"POSTPATH_FEATURE_LINK_PREVIEWS": &c.Features.LinkPreviews,
+	}
+
+	for name, field := range texts {
+		if v, ok := lookup(name); ok {
+			*field = v
+		}
+	}
+	for name, field := range ints {
+		if v, ok := lookup(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*field = n
+		}
+	}
+	for name, field := range floats {
+		if v, ok := lookup(name); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*field = f
+		}
+	}
+	for name, field := range durations {
+		if v, ok := lookup(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			field.Duration = d
+		}
+	}
+	for name, field := range bools {
+		if v, ok := lookup(name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*field = b
+		}
+	}
+	return nil
+}
+
+// Reports every setting that would leave the server unusable
+func (c Config) Validate() error {
+	var problems []string
+	if c.ListenAddr == "" {
+		problems = append(problems, "listen_addr is empty")
+	}
+	if c.DBPath == "" {
+		problems = append(problems, "db_path is empty")
+	}
+	if c.UploadDir == "" {
+		problems = append(problems, "upload_dir is empty")
+	}
+	if c.MaxPostLength < 1 {
+		problems = append(problems, "max_post_length must be positive")
+	}
+	if c.PageSize < 1 {
+		problems = append(problems, "page_size must be positive")
+	}
+	if c.MaxUploadMB < 1 {
+		problems = append(problems, "max_upload_mb must be positive")
+	}
+	if c.BackupDir == "" {
+		problems = append(problems, "backup_dir is empty")
+	}
+	if c.BackupKeep < 1 {
+		problems = append(problems, "backup_keep must be positive")
+	}
+	if c.BackupInterval.Duration < 0 {
+		problems = append(problems, "backup_interval cannot be negative")
+	}
+	if c.MinFreeDiskMB < 0 {
+		problems = append(problems, "min_free_disk_mb cannot be negative")
+	}
+	switch c.TraceExporter {
+	case "none", "otlp", "memory":
+	default:
+		problems = append(problems, "trace_exporter must be none, otlp or memory")
+	}
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		problems = append(problems, "trace_sample_ratio must be between 0 and 1")
+	}
+	for name, d := range map[string]Duration{
+		"session_lifetime": c.SessionLifetime,
+		"db_timeout":       c.DBTimeout,
+	} {
+		if d.Duration <= 0 {
+			problems = append(problems, name+" must be positive")
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("config: " + strings.Join(problems, ", "))
+	}
+	return nil
+}
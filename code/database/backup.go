@@ -0,0 +1,313 @@
+package database
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"postpath/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshots are named postpath-<UTC time>.db.gz so they sort by age
+const (
+	backupPrefix     = "postpath-"
+	backupSuffix     = ".db.gz"
+	backupTimeLayout = "20060102-150405"
+)
+
+// How long a single backup may take before it is abandoned
+const backupTimeout = 10 * time.Minute
+
+// A compressed copy of the database in the backup directory
+type Snapshot struct {
+	Name string
+	Path string
+	Time time.Time
+	Size int64
+}
+
+var (
+	stopBackups  context.CancelFunc
+	backupsGroup sync.WaitGroup
+)
+
+// Takes a snapshot every interval, keeping the newest keep of them. The first
+// one is due an interval after the newest existing snapshot, so frequent
+// restarts do not put backups off forever.
+func StartBackups(ctx context.Context, dir string, interval time.Duration, keep int) {
+	if current.name() != "sqlite" {
+		slog.Warn("Backups are only taken of SQLite databases; use pg_dump for PostgreSQL")
+		return
+	}
+	ctx, stopBackups = context.WithCancel(ctx)
+
+	wait := interval
+	if snapshots, err := ListBackups(dir); err == nil && len(snapshots) > 0 {
+		wait = max(interval-time.Since(snapshots[0].Time), 0)
+	}
+
+	backupsGroup.Add(1)
+	go func() {
+		defer backupsGroup.Done()
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			runScheduledBackup(ctx, dir, keep)
+			timer.Reset(interval)
+		}
+	}()
+	slog.Info("Backups scheduled", "dir", dir, "interval", interval, "keep", keep, "next_in", wait)
+}
+
+// Stops the scheduler, waiting for a backup in progress to be abandoned
+func StopBackups() {
+	if stopBackups == nil {
+		return
+	}
+	stopBackups()
+	backupsGroup.Wait()
+}
+
+func runScheduledBackup(ctx context.Context, dir string, keep int) {
+	snapshot, err := Backup(ctx, dir)
+	if err != nil {
+		if ctx.Err() == nil {
+			metrics.BackupFailed()
+			slog.Error("Backup failed", "err", err)
+		}
+		return
+	}
+	metrics.BackupCompleted(snapshot.Time)
+	slog.Info("Backup complete", "snapshot", snapshot.Name, "bytes", snapshot.Size)
+
+	removed, err := PruneBackups(dir, keep)
+	if err != nil {
+		slog.Error("Failed to prune backups", "err", err)
+	}
+	for _, old := range removed {
+		slog.Info("Backup removed", "snapshot", old.Name)
+	}
+}
+
+// Writes a compressed snapshot of the open database to dir. The copy is
+// made with VACUUM INTO, which reads a consistent view while the site keeps
+// serving, and is integrity checked before it is compressed.
+func Backup(ctx context.Context, dir string) (Snapshot, error) {
+	if current.name() != "sqlite" {
+		return Snapshot{}, errors.New("backups are only taken of SQLite databases; use pg_dump for PostgreSQL")
+	}
+	ctx, cancel := context.WithTimeout(ctx, backupTimeout)
+	defer cancel()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Snapshot{}, err
+	}
+	now := time.Now().UTC()
+	name := backupPrefix + now.Format(backupTimeLayout) + backupSuffix
+	path := filepath.Join(dir, name)
+
+	// Leading dots keep partial files out of ListBackups
+	raw := filepath.Join(dir, "."+strings.TrimSuffix(name, ".gz")+".tmp")
+	os.Remove(raw)
+	defer os.Remove(raw)
+	if err := vacuumInto(ctx, raw); err != nil {
+		return Snapshot{}, fmt.Errorf("copy database: %w", err)
+	}
+	if err := checkIntegrity(ctx, raw); err != nil {
+		return Snapshot{}, err
+	}
+
+	compressed := filepath.Join(dir, "."+name+".tmp")
+	defer os.Remove(compressed)
+	if err := compressFile(raw, compressed); err != nil {
+		return Snapshot{}, fmt.Errorf("compress snapshot: %w", err)
+	}
+	if err := os.Rename(compressed, path); err != nil {
+		return Snapshot{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return Snapshot{Name: name, Path: path, Time: now, Size: info.Size()}, nil
+}
+
+// Lists the snapshots in dir, newest first. A missing dir has none.
+func ListBackups(dir string) ([]Snapshot, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		taken, err := time.Parse(backupTimeLayout, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, Snapshot{Name: name, Path: filepath.Join(dir, name), Time: taken, Size: info.Size()})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.After(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+// Deletes all but the newest keep snapshots and returns the ones removed
+func PruneBackups(dir string, keep int) ([]Snapshot, error) {
+	snapshots, err := ListBackups(dir)
+	if err != nil || len(snapshots) <= keep {
+		return nil, err
+	}
+	var removed []Snapshot
+	for _, snapshot := range snapshots[keep:] {
+		if err := os.Remove(snapshot.Path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, snapshot)
+	}
+	return removed, nil
+}
+
+// Replaces the database at dbPath with a snapshot. The snapshot is
+// decompressed and integrity checked first, and the database it replaces is
+// kept beside it with a .pre-restore suffix. The server must be stopped.
+func RestoreBackup(ctx context.Context, snapshotPath string, dbPath string) error {
+	restored := dbPath + ".restore.tmp"
+	os.Remove(restored)
+	defer os.Remove(restored)
+	if err := decompressFile(snapshotPath, restored); err != nil {
+		return fmt.Errorf("decompress snapshot: %w", err)
+	}
+	if err := checkIntegrity(ctx, restored); err != nil {
+		return err
+	}
+
+	// The write-ahead log and shared memory files belong to the old database
+	// and would corrupt the restored one if left in place
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err := os.Rename(dbPath+suffix, dbPath+".pre-restore"+suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(restored, dbPath)
+}
+
+// Copies the database to path on a connection of its own. The read pool
+// refuses VACUUM INTO and the writer would hold up every write meanwhile.
+func vacuumInto(ctx context.Context, path string) error {
+	conn, err := sql.Open(driverName, dataSource(sourceName, false))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, `VACUUM INTO ?`, path)
+	return err
+}
+
+// Runs SQLite's integrity check on the database file at path
+func checkIntegrity(ctx context.Context, path string) error {
+	check, err := sql.Open(driverName, "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer check.Close()
+
+	rows, err := check.QueryContext(ctx, `PRAGMA integrity_check`)
+	if err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func compressFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func decompressFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, zr); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
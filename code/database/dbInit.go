@@ -3,41 +3,92 @@ package database
 import (
 	"context"
 	"database/sql"
-	"log"
+	"postpath/logging"
+	"postpath/metrics"
 	"strings"
 	"time"
+)
 
-	_ "github.com/mattn/go-sqlite3"
+// Writes go through db and reads through readDB. On SQLite these are a
+// single writer connection and a separate read pool; on PostgreSQL they
+// are the same pool.
+var (
+	db     *sql.DB
+	readDB *sql.DB
 )
 
-var db *sql.DB
+// The database in use, chosen by the data source name
+var current dialect = sqliteDialect{}
 
-func InitDB(dataSourceName string) {
+// How long a single query may run before it is cancelled
+var queryTimeout = 5 * time.Second
 
-	var err error
-	db, err = sql.Open("sqlite3", dataSourceName)
-	if err != nil {
-		log.Fatal(err)
-	}
-	// Set connection pool settings
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(25)
-	db.SetConnMaxLifetime(5 * time.Minute)
+// Tables created by InitDB, checked for by CheckSchema
+var schemaTables = []string{
+	"users", "pages", "pagetext", "page_aliases", "mentions", "notifications",
+	"follows", "page_watches", "page_visits", "collections", "collection_items",
+	"reactions", "attachments", "link_previews",
+}
+
+// Columns InitDB has added to existing tables, as table and column name
+var addedColumns [][2]string
 
-	// Verify connection
-	if err = db.Ping(); err != nil {
-		log.Fatalf("Failed to ping database: %v", err)
+// Opens the database and brings its schema up to date. dataSourceName is a
+// SQLite file path or a postgres:// URL.
+func InitDB(dataSourceName string, timeout time.Duration) {
+	if err := Open(dataSourceName, timeout); err != nil {
+		logging.Fatal("Failed to open database", "err", err)
 	}
+	current.migrate()
+}
+
+// Opens the database without touching its schema, for commands that run
+// alongside the server
+func Open(dataSourceName string, timeout time.Duration) error {
+	queryTimeout = timeout
+	current = dialectFor(dataSourceName)
 
-	createUserTable()
-	createPageTables()
-	modifyPageTextTable()
+	var err error
+	db, readDB, err = current.open(dataSourceName)
+	return err
 }
 
+// Returns the writer connection. Reads belong on the read pool, reached
+// through QueryWithTimeout and QueryRowWithTimeout.
 func DB() *sql.DB {
 	return db
 }
 
+// Picks the pool for a statement: reads go to the read pool and anything
+// else, including INSERT ... RETURNING, to the writer
+func poolFor(query string) *sql.DB {
+	switch statementOperation(query) {
+	case "SELECT", "WITH":
+		return readDB
+	}
+	return db
+}
+
+// Closes the database, first letting it tidy up: SQLite folds its
+// write-ahead log back into the file so a stopped container leaves a single
+// consistent file behind
+func Close() error {
+	current.close()
+	if readDB != db {
+		readDB.Close()
+	}
+	return db.Close()
+}
+
+// Confirms the database has every table and added column this build expects,
+// which catches a database swapped or restored from an older release
+func CheckSchema(ctx context.Context) error {
+	return current.checkSchema(ctx)
+}
+
+// SQLite schema. Tables are created if missing and later columns are added
+// in place, so any older database file is brought up to date.
+
 func createUserTable() {
 	query := `
 	CREATE TABLE IF NOT EXISTS users (
@@ -47,7 +98,7 @@ func createUserTable() {
 		password TEXT NOT NULL
 	);`
 	if _, err := db.Exec(query); err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to update schema", "err", err)
 	}
 }
 
@@ -58,7 +109,7 @@ func createPageTables() {
 		title TEXT NOT NULL UNIQUE
 	);`
 	if _, err := db.Exec(pageTable); err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to update schema", "err", err)
 	}
 
 	pageTextTable := `
@@ -79,52 +130,333 @@ func createPageTables() {
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);`
 	if _, err := db.Exec(pageTextTable); err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+
+	aliasTable := `
+	CREATE TABLE IF NOT EXISTS page_aliases (
+		alias TEXT PRIMARY KEY,
+		page_id INTEGER NOT NULL,
+		FOREIGN KEY(page_id) REFERENCES pages(id)
+	);`
+	if _, err := db.Exec(aliasTable); err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
 	}
 
 	// Insert Home page if it doesn't exist
 	_, err := db.Exec(`INSERT OR IGNORE INTO pages (id, title) VALUES (0, 'Home')`)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to update schema", "err", err)
 	}
 	// Insert Home page if it doesn't exist
 	_, err = db.Exec(`INSERT OR IGNORE INTO pages (id, title) VALUES (1, 'Profile')`)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+}
+
+func createNotificationTables() {
+	mentionTable := `
+	CREATE TABLE IF NOT EXISTS mentions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		text_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(text_id, user_id),
+		FOREIGN KEY(text_id) REFERENCES pagetext(id) ON DELETE CASCADE,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	if _, err := db.Exec(mentionTable); err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+
+	notificationTable := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		actor_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		page_id INTEGER,
+		text_id INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		read_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(actor_id) REFERENCES users(id),
+		FOREIGN KEY(page_id) REFERENCES pages(id),
+		FOREIGN KEY(text_id) REFERENCES pagetext(id) ON DELETE CASCADE
+	);`
+	if _, err := db.Exec(notificationTable); err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+}
+
+func createFollowTable() {
+	query := `
+	CREATE TABLE IF NOT EXISTS follows (
+		follower_id INTEGER NOT NULL,
+		followee_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(follower_id, followee_id),
+		FOREIGN KEY(follower_id) REFERENCES users(id),
+		FOREIGN KEY(followee_id) REFERENCES users(id)
+	);`
+	if _, err := db.Exec(query); err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+}
+
+func createWatchTables() {
+	watchTable := `
+	CREATE TABLE IF NOT EXISTS page_watches (
+		user_id INTEGER NOT NULL,
+		page_id INTEGER NOT NULL,
+		path TEXT NOT NULL,
+		depth INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(user_id, page_id),
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(page_id) REFERENCES pages(id)
+	);`
+	if _, err := db.Exec(watchTable); err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+
+	visitTable := `
+	CREATE TABLE IF NOT EXISTS page_visits (
+		user_id INTEGER NOT NULL,
+		page_id INTEGER NOT NULL,
+		last_seen_at DATETIME NOT NULL,
+		PRIMARY KEY(user_id, page_id),
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(page_id) REFERENCES pages(id)
+	);`
+	if _, err := db.Exec(visitTable); err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+}
+
+func createCollectionTables() {
+	collectionTable := `
+	CREATE TABLE IF NOT EXISTS collections (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(user_id, name),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	if _, err := db.Exec(collectionTable); err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+
+	itemTable := `
+	CREATE TABLE IF NOT EXISTS collection_items (
+		collection_id INTEGER NOT NULL,
+		text_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(collection_id, text_id),
+		FOREIGN KEY(collection_id) REFERENCES collections(id) ON DELETE CASCADE,
+		FOREIGN KEY(text_id) REFERENCES pagetext(id) ON DELETE CASCADE
+	);`
+	if _, err := db.Exec(itemTable); err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+}
+
+func createReactionTable() {
+	query := `
+	CREATE TABLE IF NOT EXISTS reactions (
+		user_id INTEGER NOT NULL,
+		text_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(user_id, text_id, kind),
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(text_id) REFERENCES pagetext(id) ON DELETE CASCADE
+	);`
+	if _, err := db.Exec(query); err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+}
+
+func createAttachmentTable() {
+	query := `
+	CREATE TABLE IF NOT EXISTS attachments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		text_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		storage_key TEXT NOT NULL,
+		thumb_key TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(text_id) REFERENCES pagetext(id) ON DELETE CASCADE,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);`
+	if _, err := db.Exec(query); err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+}
+
+func createLinkPreviewTable() {
+	query := `
+	CREATE TABLE IF NOT EXISTS link_previews (
+		url TEXT PRIMARY KEY,
+		status TEXT NOT NULL DEFAULT 'pending',
+		title TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		image_url TEXT NOT NULL DEFAULT '',
+		site_name TEXT NOT NULL DEFAULT '',
+		fetched_at DATETIME
+	);`
+	if _, err := db.Exec(query); err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
 	}
 }
 
+// Indexes for the lookups pages are built from, and for the child side of
+// each cascading foreign key so deleting a text does not scan every table
+func createIndexes() {
+	indexes := []string{
+		`CREATE INDEX IF NOT EXISTS idx_pagetext_page ON pagetext(page_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_pagetext_user ON pagetext(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_pagetext_parent ON pagetext(parent_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_pagetext_link ON pagetext(link_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications(user_id, created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_notifications_text ON notifications(text_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_reactions_text ON reactions(text_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_attachments_text ON attachments(text_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_collection_items_text ON collection_items(text_id)`,
+	}
+	for _, index := range indexes {
+		if _, err := db.Exec(index); err != nil {
+			logging.Fatal("Failed to update schema", "err", err)
+		}
+	}
+}
+
+func modifyUserTable() {
+	addColumn("users", "is_moderator INTEGER DEFAULT 0")
+	// Whether other users may post on this user's profile
+	addColumn("users", "open_profile INTEGER DEFAULT 0")
+}
+
+func modifyPageTable() {
+	addColumn("pages", "description TEXT")
+	addColumn("pages", "owner_id INTEGER REFERENCES users(id)")
+	addColumn("pages", "slug TEXT")
+}
+
 func modifyPageTextTable() {
-	_, err := db.Exec(`ALTER TABLE pagetext ADD COLUMN source INTEGER`)
+	addColumn("pagetext", "source INTEGER")
+	addColumn("pagetext", "is_pinned INTEGER DEFAULT 0")
+	addColumn("pagetext", "revision INTEGER DEFAULT 0")
+	addColumn("pagetext", "parent_id INTEGER REFERENCES pagetext(id) ON DELETE CASCADE")
+	// The user whose profile a post was left on, when not the author's own
+	addColumn("pagetext", "profile_id INTEGER REFERENCES users(id)")
+}
+
+// Adds a column to an existing table, ignoring it if it is already there
+func addColumn(table, column string) {
+	_, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column)
 	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
-		log.Fatal(err)
+		logging.Fatal("Failed to update schema", "err", err)
 	}
+	addedColumns = append(addedColumns, [2]string{table, strings.Fields(column)[0]})
 }
 
-// Add this function to handle timeouts
-func QueryWithTimeout(query string, args ...interface{}) (*sql.Rows, context.CancelFunc, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	rows, err := db.QueryContext(ctx, query, args...)
+// Runs a query as part of the caller's trace, cut off after the query
+// timeout. The caller's own cancellation is ignored so a client hanging up
+// cannot leave a request's writes half done. The caller must defer the
+// returned cancel function, which also ends the trace span once the rows
+// have been read.
+func QueryWithTimeout(ctx context.Context, query string, args ...interface{}) (*sql.Rows, context.CancelFunc, error) {
+	defer metrics.ObserveQuery("query", time.Now())
+	ctx, span := startSpan(ctx, query)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	rows, err := poolFor(query).QueryContext(ctx, query, args...)
 	if err != nil {
+		endSpan(span, err)
 		cancel() // safe to cancel if there's an error
 		return nil, nil, err
 	}
-	return rows, cancel, nil
+	return rows, func() { endSpan(span, nil); cancel() }, nil
 }
 
 // Returns sql.Row and a cancel function the caller must defer
-func QueryRowWithTimeout(query string, args ...interface{}) (*sql.Row, context.CancelFunc) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	return db.QueryRowContext(ctx, query, args...), cancel
+func QueryRowWithTimeout(ctx context.Context, query string, args ...interface{}) (*sql.Row, context.CancelFunc) {
+	defer metrics.ObserveQuery("query_row", time.Now())
+	ctx, span := startSpan(ctx, query)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	row := poolFor(query).QueryRowContext(ctx, query, args...)
+	return row, func() { endSpan(span, row.Err()); cancel() }
 }
 
 // Returns sql.Result and a cancel function the caller must defer
-func ExecWithTimeout(query string, args ...interface{}) (sql.Result, context.CancelFunc, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func ExecWithTimeout(ctx context.Context, query string, args ...interface{}) (sql.Result, context.CancelFunc, error) {
+	defer metrics.ObserveQuery("exec", time.Now())
+	ctx, span := startSpan(ctx, query)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
 	result, err := db.ExecContext(ctx, query, args...)
+	endSpan(span, err)
 	if err != nil {
 		cancel() // cancel early if failed
 		return nil, nil, err
 	}
 	return result, cancel, nil
 }
+
+// Returns sql.Rows from a statement inside tx and a cancel function the
+// caller must defer
+func TxQueryWithTimeout(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (*sql.Rows, context.CancelFunc, error) {
+	defer metrics.ObserveQuery("query", time.Now())
+	ctx, span := startSpan(ctx, query)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		endSpan(span, err)
+		cancel() // safe to cancel if there's an error
+		return nil, nil, err
+	}
+	return rows, func() { endSpan(span, nil); cancel() }, nil
+}
+
+// Returns sql.Row from a statement inside tx and a cancel function the
+// caller must defer
+func TxQueryRowWithTimeout(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (*sql.Row, context.CancelFunc) {
+	defer metrics.ObserveQuery("query_row", time.Now())
+	ctx, span := startSpan(ctx, query)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	row := tx.QueryRowContext(ctx, query, args...)
+	return row, func() { endSpan(span, row.Err()); cancel() }
+}
+
+// Returns sql.Result from a statement inside tx and a cancel function the
+// caller must defer
+func TxExecWithTimeout(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (sql.Result, context.CancelFunc, error) {
+	defer metrics.ObserveQuery("exec", time.Now())
+	ctx, span := startSpan(ctx, query)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	result, err := tx.ExecContext(ctx, query, args...)
+	endSpan(span, err)
+	if err != nil {
+		cancel() // cancel early if failed
+		return nil, nil, err
+	}
+	return result, cancel, nil
+}
+
+// Returns sql.Tx and a cancel function the caller must defer
+func BeginWithTimeout(ctx context.Context) (*sql.Tx, context.CancelFunc, error) {
+	defer metrics.ObserveQuery("begin", time.Now())
+	ctx, span := startSpan(ctx, "BEGIN")
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		endSpan(span, err)
+		cancel() // cancel early if failed
+		return nil, nil, err
+	}
+	return tx, func() { endSpan(span, nil); cancel() }, nil
+}
@@ -0,0 +1,37 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// What differs between the databases the server can run on. Queries are
+// written once, with ? placeholders and SQL both databases accept; each
+// dialect supplies the connections, schema and housekeeping around them.
+type dialect interface {
+	// Name recorded on trace spans, e.g. "sqlite"
+	name() string
+	// Opens the pools writes and reads go through, which may be the same
+	open(dataSourceName string) (writer *sql.DB, reader *sql.DB, err error)
+	// Creates the schema or brings an existing one up to date
+	migrate()
+	// Reports the first table or column this build expects that is missing
+	checkSchema(ctx context.Context) error
+	// Runs before the pools are closed
+	close()
+}
+
+// Picks PostgreSQL for postgres:// and postgresql:// URLs and SQLite for
+// anything else, which is taken as a file path
+func dialectFor(dataSourceName string) dialect {
+	if IsPostgres(dataSourceName) {
+		return postgresDialect{}
+	}
+	return sqliteDialect{}
+}
+
+// Reports whether a data source name selects PostgreSQL
+func IsPostgres(dataSourceName string) bool {
+	return strings.HasPrefix(dataSourceName, "postgres://") || strings.HasPrefix(dataSourceName, "postgresql://")
+}
@@ -0,0 +1,36 @@
+//go:build !purego
+
+package database
+
+import (
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Name the SQLite driver registered itself under. This is the cgo driver;
+// build with -tags purego for one that needs no C compiler.
+const driverName = "sqlite3"
+
+// Adds the connection settings to a data source name. They are set through
+// the name so every connection the pools open gets them. Writers take the
+// write lock when a transaction begins, so two transactions never both read
+// and then fail to upgrade; readers are refused any write.
+func dataSource(path string, readOnly bool) string {
+	params := []string{
+		"_busy_timeout=" + strconv.Itoa(int(busyTimeout.Milliseconds())),
+		"_foreign_keys=on",
+		"_synchronous=NORMAL",
+	}
+	if readOnly {
+		params = append(params, "_query_only=true")
+	} else {
+		params = append(params, "_journal_mode=WAL", "_txlock=immediate")
+	}
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + strings.Join(params, "&")
+}
@@ -0,0 +1,36 @@
+//go:build purego
+
+package database
+
+import (
+	"strconv"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// Name the SQLite driver registered itself under. This is the pure Go
+// driver, which lets the binary build with CGO_ENABLED=0.
+const driverName = "sqlite"
+
+// Adds the same connection settings as the cgo build, spelled as this
+// driver's pragmas. Times are written in the layout the cgo driver uses so
+// a database file works with either build.
+func dataSource(path string, readOnly bool) string {
+	params := []string{
+		"_pragma=busy_timeout(" + strconv.Itoa(int(busyTimeout.Milliseconds())) + ")",
+		"_pragma=foreign_keys(1)",
+		"_pragma=synchronous(NORMAL)",
+		"_time_format=sqlite",
+	}
+	if readOnly {
+		params = append(params, "_pragma=query_only(1)")
+	} else {
+		params = append(params, "_pragma=journal_mode(WAL)", "_txlock=immediate")
+	}
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + strings.Join(params, "&")
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Both drivers must write times as StoredTimeLayout text, which aggregates
+// hand back unparsed and which lets either build open the other's files
+func TestStoredTimeLayout(t *testing.T) {
+	openTestSQLite(t)
+	ctx := context.Background()
+
+	exec(t, `INSERT INTO users (id, username, email, password) VALUES (1, 'alice', 'alice@example.com', 'x')`)
+	exec(t, `INSERT INTO pages (id, title, slug) VALUES (2, 'Apples', 'apples')`)
+	written := time.Date(2024, 3, 9, 17, 4, 5, 123456789, time.FixedZone("", 5*60*60+30*60))
+	exec(t, `INSERT INTO page_visits (user_id, page_id, last_seen_at) VALUES (1, 2, ?)`, written)
+
+	var stored string
+	row, cancel := QueryRowWithTimeout(ctx, `SELECT MAX(last_seen_at) FROM page_visits`)
+	defer cancel()
+	if err := row.Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if want := written.Format(StoredTimeLayout); stored != want {
+		t.Fatalf("stored %q, want %q", stored, want)
+	}
+	parsed, err := time.Parse(StoredTimeLayout, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(written) {
+		t.Errorf("parsed %v, want %v", parsed, written)
+	}
+
+	// The column read on its own scans straight into a time
+	var scanned time.Time
+	row, cancel = QueryRowWithTimeout(ctx, `SELECT last_seen_at FROM page_visits WHERE user_id = 1`)
+	defer cancel()
+	if err := row.Scan(&scanned); err != nil {
+		t.Fatal(err)
+	}
+	if !scanned.Equal(written) {
+		t.Errorf("scanned %v, want %v", scanned, written)
+	}
+}
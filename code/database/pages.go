@@ -0,0 +1,264 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"postpath/logging"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Slugs identify pages regardless of spacing, case, hyphens or underscores,
+// so "Machine Learning" and "machine-learning" are the same page
+func Slugify(title string) string {
+	words := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return unicode.IsSpace(r) || r == '-' || r == '_'
+	})
+	return strings.Join(words, "-")
+}
+
+// Moves everything on one page into another and leaves an alias behind so
+// future links to the old title resolve to the canonical page
+func MergePages(ctx context.Context, fromId int, intoId int) error {
+	tx, cancel, err := BeginWithTimeout(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	defer tx.Rollback()
+
+	if err := mergePagesTx(ctx, tx, fromId, intoId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func mergePagesTx(ctx context.Context, tx *sql.Tx, fromId int, intoId int) error {
+	var fromTitle string
+	var fromDescription sql.NullString
+	row, cancel := TxQueryRowWithTimeout(ctx, tx, `SELECT title, description FROM pages WHERE id = ?`, fromId)
+	err := row.Scan(&fromTitle, &fromDescription)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	// Users watching or visiting both pages keep their entry for the
+	// canonical page
+	duplicates := []string{
+		`DELETE FROM page_watches WHERE page_id = ? AND user_id IN (SELECT user_id FROM page_watches WHERE page_id = ?)`,
+		`DELETE FROM page_visits WHERE page_id = ? AND user_id IN (SELECT user_id FROM page_visits WHERE page_id = ?)`,
+	}
+	for _, statement := range duplicates {
+		_, cancel, err := TxExecWithTimeout(ctx, tx, statement, fromId, intoId)
+		if err != nil {
+			return err
+		}
+		cancel()
+	}
+
+	statements := []string{
+		`UPDATE pagetext SET page_id = ? WHERE page_id = ?`,
+		`UPDATE pagetext SET link_id = ? WHERE link_id = ?`,
+		`UPDATE pagetext SET source = ? WHERE source = ?`,
+		`UPDATE page_aliases SET page_id = ? WHERE page_id = ?`,
+		`UPDATE notifications SET page_id = ? WHERE page_id = ?`,
+		`UPDATE page_watches SET page_id = ? WHERE page_id = ?`,
+		`UPDATE page_visits SET page_id = ? WHERE page_id = ?`,
+	}
+	for _, statement := range statements {
+		_, cancel, err := TxExecWithTimeout(ctx, tx, statement, intoId, fromId)
+		if err != nil {
+			return err
+		}
+		cancel()
+	}
+
+	if err := mergePaths(ctx, tx, "pagetext", []string{"id"}, fromId, intoId); err != nil {
+		return err
+	}
+	if err := mergePaths(ctx, tx, "page_watches", []string{"user_id", "page_id"}, fromId, intoId); err != nil {
+		return err
+	}
+
+	_, cancel, err = TxExecWithTimeout(ctx, tx, `UPDATE pages SET description = ? WHERE id = ? AND COALESCE(description, '') = ''`, fromDescription, intoId)
+	if err != nil {
+		return err
+	}
+	cancel()
+
+	_, cancel, err = TxExecWithTimeout(ctx, tx, `
+		INSERT INTO page_aliases (alias, page_id) VALUES (?, ?)
+		ON CONFLICT(alias) DO UPDATE SET page_id = excluded.page_id
+	`, Slugify(fromTitle), intoId)
+	if err != nil {
+		return err
+	}
+	cancel()
+
+	_, cancel, err = TxExecWithTimeout(ctx, tx, `DELETE FROM pages WHERE id = ?`, fromId)
+	if err != nil {
+		return err
+	}
+	cancel()
+
+	return nil
+}
+
+// Rewrites the stored paths in a table that pass through the merged page.
+// Rows are identified by the given integer key columns.
+func mergePaths(ctx context.Context, tx *sql.Tx, table string, keys []string, fromId int, intoId int) error {
+	from := strconv.Itoa(fromId)
+	into := strconv.Itoa(intoId)
+
+	rows, cancel, err := TxQueryWithTimeout(ctx, tx, `
+		SELECT `+strings.Join(keys, ", ")+`, path FROM `+table+`
+		WHERE path = ? OR path LIKE ? OR path LIKE ? OR path LIKE ?
+	`, from, from+"/%", "%/"+from, "%/"+from+"/%")
+	if err != nil {
+		return err
+	}
+
+	var updates [][]any
+	for rows.Next() {
+		keyValues := make([]int, len(keys))
+		dest := make([]any, 0, len(keys)+1)
+		for i := range keyValues {
+			dest = append(dest, &keyValues[i])
+		}
+		var path string
+		dest = append(dest, &path)
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			cancel()
+			return err
+		}
+
+		segments := strings.Split(path, "/")
+		for i, segment := range segments {
+			if segment == from {
+				segments[i] = into
+			}
+		}
+		args := []any{strings.Join(segments, "/")}
+		for _, value := range keyValues {
+			args = append(args, value)
+		}
+		updates = append(updates, args)
+	}
+	rows.Close()
+	cancel()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	conditions := make([]string, len(keys))
+	for i, key := range keys {
+		conditions[i] = key + " = ?"
+	}
+	update := `UPDATE ` + table + ` SET path = ? WHERE ` + strings.Join(conditions, " AND ")
+	for _, args := range updates {
+		_, cancel, err := TxExecWithTimeout(ctx, tx, update, args...)
+		if err != nil {
+			return err
+		}
+		cancel()
+	}
+	return nil
+}
+
+// Gives every page a slug, merges pages whose slugs collide into the oldest
+// of them and then holds slugs unique, so each slug names a single page
+func uniquePageSlugs() {
+	tx, err := db.Begin()
+	if err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+	defer tx.Rollback()
+
+	if err := backfillPageSlugs(tx); err != nil {
+		logging.Fatal("Failed to backfill page slugs", "err", err)
+	}
+	if err := mergeDuplicateSlugs(tx); err != nil {
+		logging.Fatal("Failed to merge pages with the same slug", "err", err)
+	}
+	statements := []string{
+		`DROP INDEX IF EXISTS idx_pages_slug`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_pages_slug_unique ON pages(slug)`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			logging.Fatal("Failed to update schema", "err", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+}
+
+// Fills in slugs for pages created before slugs existed. Home and Profile
+// are reached by id and have none.
+func backfillPageSlugs(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, title FROM pages WHERE slug IS NULL AND id NOT IN (0, 1)`)
+	if err != nil {
+		return err
+	}
+	slugs := map[int]string{}
+	for rows.Next() {
+		var id int
+		var title string
+		if err := rows.Scan(&id, &title); err != nil {
+			rows.Close()
+			return err
+		}
+		slugs[id] = Slugify(title)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, slug := range slugs {
+		if _, err := tx.Exec(`UPDATE pages SET slug = ? WHERE id = ?`, slug, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merges each page into the oldest page sharing its slug, leaving an alias
+// behind as a moderator's merge would
+func mergeDuplicateSlugs(tx *sql.Tx) error {
+	rows, err := tx.Query(`
+		SELECT pages.id, canonical.id
+		FROM pages
+		INNER JOIN (SELECT slug, MIN(id) AS id FROM pages WHERE slug IS NOT NULL GROUP BY slug) canonical
+			ON canonical.slug = pages.slug
+		WHERE pages.id != canonical.id
+		ORDER BY pages.id
+	`)
+	if err != nil {
+		return err
+	}
+	var merges [][2]int
+	for rows.Next() {
+		var fromId, intoId int
+		if err := rows.Scan(&fromId, &intoId); err != nil {
+			rows.Close()
+			return err
+		}
+		merges = append(merges, [2]int{fromId, intoId})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, merge := range merges {
+		if err := mergePagesTx(context.Background(), tx, merge[0], merge[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"postpath/logging"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// Connections a server keeps open to PostgreSQL. Reads and writes share
+// them, since PostgreSQL has no single writer to queue behind.
+const postgresConns = 25
+
+// Key for the advisory lock held while migrating, so servers starting
+// together do not apply the same migration twice
+const migrationLock = 7274_7068
+
+// PostgreSQL schema changes, applied in order and recorded in
+// schema_migrations. Unlike SQLite's schema, which is patched in place,
+// every change here is a new entry; applied entries must never be edited.
+var migrations = []func(tx *sql.Tx) error{
+	// 1: the schema as of the first PostgreSQL release
+	execMigration(`
+	CREATE TABLE users (
+		id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE,
+		email TEXT NOT NULL UNIQUE,
+		password TEXT NOT NULL,
+		is_moderator INTEGER DEFAULT 0
+	);
+
+	CREATE TABLE pages (
+		id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		title TEXT NOT NULL UNIQUE,
+		description TEXT,
+		owner_id INTEGER REFERENCES users(id),
+		slug TEXT
+	);
+	CREATE INDEX idx_pages_slug ON pages(slug);
+
+	CREATE TABLE pagetext (
+		id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		page_id INTEGER NOT NULL REFERENCES pages(id),
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		text TEXT NOT NULL,
+		is_link INTEGER DEFAULT 0,
+		link_id INTEGER REFERENCES pages(id),
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		is_edited INTEGER DEFAULT 0,
+		path TEXT,
+		source INTEGER REFERENCES pages(id),
+		is_pinned INTEGER DEFAULT 0,
+		revision INTEGER DEFAULT 0,
+		parent_id INTEGER REFERENCES pagetext(id) ON DELETE CASCADE
+	);
+	CREATE INDEX idx_pagetext_page ON pagetext(page_id, created_at);
+	CREATE INDEX idx_pagetext_user ON pagetext(user_id);
+	CREATE INDEX idx_pagetext_parent ON pagetext(parent_id);
+	CREATE INDEX idx_pagetext_link ON pagetext(link_id);
+
+	CREATE TABLE page_aliases (
+		alias TEXT PRIMARY KEY,
+		page_id INTEGER NOT NULL REFERENCES pages(id)
+	);
+
+	CREATE TABLE mentions (
+		id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		text_id INTEGER NOT NULL REFERENCES pagetext(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(text_id, user_id)
+	);
+
+	CREATE TABLE notifications (
+		id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		actor_id INTEGER NOT NULL REFERENCES users(id),
+		kind TEXT NOT NULL,
+		page_id INTEGER REFERENCES pages(id),
+		text_id INTEGER REFERENCES pagetext(id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		read_at TIMESTAMPTZ
+	);
+	CREATE INDEX idx_notifications_user ON notifications(user_id, created_at);
+	CREATE INDEX idx_notifications_text ON notifications(text_id);
+
+	CREATE TABLE follows (
+		follower_id INTEGER NOT NULL REFERENCES users(id),
+		followee_id INTEGER NOT NULL REFERENCES users(id),
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(follower_id, followee_id)
+	);
+
+	CREATE TABLE page_watches (
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		page_id INTEGER NOT NULL REFERENCES pages(id),
+		path TEXT NOT NULL,
+		depth INTEGER DEFAULT 0,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(user_id, page_id)
+	);
+
+	CREATE TABLE page_visits (
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		page_id INTEGER NOT NULL REFERENCES pages(id),
+		last_seen_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY(user_id, page_id)
+	);
+
+	CREATE TABLE collections (
+		id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		name TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(user_id, name)
+	);
+
+	CREATE TABLE collection_items (
+		collection_id INTEGER NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+		text_id INTEGER NOT NULL REFERENCES pagetext(id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(collection_id, text_id)
+	);
+	CREATE INDEX idx_collection_items_text ON collection_items(text_id);
+
+	CREATE TABLE reactions (
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		text_id INTEGER NOT NULL REFERENCES pagetext(id) ON DELETE CASCADE,
+		kind TEXT NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(user_id, text_id, kind)
+	);
+	CREATE INDEX idx_reactions_text ON reactions(text_id);
+
+	CREATE TABLE attachments (
+		id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		text_id INTEGER NOT NULL REFERENCES pagetext(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		storage_key TEXT NOT NULL,
+		thumb_key TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX idx_attachments_text ON attachments(text_id);
+
+	CREATE TABLE link_previews (
+		url TEXT PRIMARY KEY,
+		status TEXT NOT NULL DEFAULT 'pending',
+		title TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		image_url TEXT NOT NULL DEFAULT '',
+		site_name TEXT NOT NULL DEFAULT '',
+		fetched_at TIMESTAMPTZ
+	);
+
+	INSERT INTO pages (id, title) VALUES (0, 'Home'), (1, 'Profile') ON CONFLICT DO NOTHING;
+	SELECT setval(pg_get_serial_sequence('pages', 'id'), (SELECT MAX(id) FROM pages));
+	`),
+
+	// 2: one page per slug, merging any created by racing inserts
+	func(tx *sql.Tx) error {
+		if err := mergeDuplicateSlugs(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+		DROP INDEX idx_pages_slug;
+		CREATE UNIQUE INDEX idx_pages_slug_unique ON pages(slug);
+		`)
+		return err
+	},
+
+	// 3: posts left on another user's profile
+	execMigration(`
+	ALTER TABLE pagetext ADD COLUMN profile_id INTEGER REFERENCES users(id);
+	`),
+
+	// 4: profiles the owner has opened to posts from others
+	execMigration(`
+	ALTER TABLE users ADD COLUMN open_profile INTEGER DEFAULT 0;
+	`),
+}
+
+// A migration made only of SQL statements
+func execMigration(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// PostgreSQL reached through pgx. Queries keep SQLite's ? placeholders and
+// are rewritten to $1, $2, ... as they reach the driver.
+type postgresDialect struct{}
+
+func (postgresDialect) name() string {
+	return "postgresql"
+}
+
+func (postgresDialect) open(dataSourceName string) (*sql.DB, *sql.DB, error) {
+	config, err := pgx.ParseConfig(dataSourceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := sql.OpenDB(rebindConnector{stdlib.GetConnector(*config)})
+	pool.SetMaxOpenConns(postgresConns)
+	pool.SetMaxIdleConns(postgresConns)
+	pool.SetConnMaxLifetime(30 * time.Minute)
+	return pool, pool, pool.Ping()
+}
+
+// Applies each migration not yet recorded, in its own transaction
+func (postgresDialect) migrate() {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`)
+	if err != nil {
+		logging.Fatal("Failed to update schema", "err", err)
+	}
+
+	for i, migration := range migrations {
+		if err := applyMigration(i+1, migration); err != nil {
+			logging.Fatal("Failed to update schema", "version", i+1, "err", err)
+		}
+	}
+}
+
+func applyMigration(version int, migration func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, migrationLock); err != nil {
+		return err
+	}
+	var applied bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = ?)`, version).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+	if err := migration(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (postgresDialect) checkSchema(ctx context.Context) error {
+	var version int
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version < len(migrations) {
+		return fmt.Errorf("schema is at version %d, expected %d", version, len(migrations))
+	}
+
+	for _, table := range schemaTables {
+		var exists bool
+		err := db.QueryRowContext(ctx, `SELECT to_regclass(?) IS NOT NULL`, table).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("table %s is missing", table)
+		}
+	}
+	return nil
+}
+
+func (postgresDialect) close() {}
+
+// Hands out connections that rewrite placeholders before pgx sees them
+type rebindConnector struct {
+	driver.Connector
+}
+
+func (c rebindConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rebindConn{conn.(*stdlib.Conn)}, nil
+}
+
+// A pgx connection taking ? placeholders. Everything besides preparing and
+// running statements is the embedded connection's own.
+type rebindConn struct {
+	*stdlib.Conn
+}
+
+func (c rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+func (c rebindConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.PrepareContext(ctx, rebind(query))
+}
+
+func (c rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.ExecContext(ctx, rebind(query), args)
+}
+
+func (c rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.QueryContext(ctx, rebind(query), args)
+}
+
+// Numbers each ? placeholder outside quoted strings and identifiers
+func rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	var quote rune
+	n := 0
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
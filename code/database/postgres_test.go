@@ -0,0 +1,30 @@
+package database
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"no placeholders", `SELECT id FROM pages`, `SELECT id FROM pages`},
+		{"numbered in order", `SELECT id FROM pages WHERE id = ? AND slug = ?`, `SELECT id FROM pages WHERE id = $1 AND slug = $2`},
+		{"adjacent", `VALUES (?,?,?)`, `VALUES ($1,$2,$3)`},
+		{"in a string", `SELECT '?' FROM pages WHERE id = ?`, `SELECT '?' FROM pages WHERE id = $1`},
+		{"escaped quote in a string", `SELECT 'it''s ?' WHERE id = ?`, `SELECT 'it''s ?' WHERE id = $1`},
+		{"in an identifier", `SELECT "why?" FROM pages WHERE id = ?`, `SELECT "why?" FROM pages WHERE id = $1`},
+		{"double quote in a string", `SELECT '"?' WHERE id = ?`, `SELECT '"?' WHERE id = $1`},
+		{"single quote in an identifier", `SELECT "it's?" WHERE id = ?`, `SELECT "it's?" WHERE id = $1`},
+		{"path concatenation", `SELECT path || '/' || ? FROM pagetext WHERE path LIKE ?`, `SELECT path || '/' || $1 FROM pagetext WHERE path LIKE $2`},
+		{"past nine", `VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, `VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`},
+		{"multibyte text", `SELECT 'héllo ?' WHERE title = ?`, `SELECT 'héllo ?' WHERE title = $1`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rebind(test.query); got != test.want {
+				t.Errorf("rebind(%q) = %q, want %q", test.query, got, test.want)
+			}
+		})
+	}
+}
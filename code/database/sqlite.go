@@ -0,0 +1,117 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// How long a connection waits on a lock held by another process, such as
+// the backup command, before giving up
+const busyTimeout = 5 * time.Second
+
+// Layout both SQLite drivers write times in. Aggregates such as
+// MAX(created_at) come back as this text rather than as a time.
+const StoredTimeLayout = "2006-01-02 15:04:05.999999999-07:00"
+
+// The SQLite file the pools were opened with
+var sourceName string
+
+// SQLite allows one writer at a time, so writes share a single connection
+// and queue for it rather than failing with "database is locked". Reads run
+// on their own pool alongside it, which WAL mode allows.
+type sqliteDialect struct{}
+
+func (sqliteDialect) name() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) open(dataSourceName string) (*sql.DB, *sql.DB, error) {
+	sourceName = dataSourceName
+
+	writer, err := sql.Open(driverName, dataSource(dataSourceName, false))
+	if err != nil {
+		return nil, nil, err
+	}
+	writer.SetMaxOpenConns(1)
+	writer.SetMaxIdleConns(1)
+	writer.SetConnMaxLifetime(0)
+	// The writer switches the file to WAL, so it connects before any reader
+	if err := writer.Ping(); err != nil {
+		return nil, nil, err
+	}
+
+	readers := max(4, runtime.NumCPU())
+	reader, err := sql.Open(driverName, dataSource(dataSourceName, true))
+	if err != nil {
+		return nil, nil, err
+	}
+	reader.SetMaxOpenConns(readers)
+	reader.SetMaxIdleConns(readers)
+	reader.SetConnMaxLifetime(5 * time.Minute)
+	return writer, reader, reader.Ping()
+}
+
+func (sqliteDialect) migrate() {
+	createUserTable()
+	createPageTables()
+	modifyUserTable()
+	modifyPageTable()
+	modifyPageTextTable()
+	createNotificationTables()
+	createFollowTable()
+	createWatchTables()
+	createCollectionTables()
+	createReactionTable()
+	createAttachmentTable()
+	createLinkPreviewTable()
+	// Merging pages touches most tables, so this waits until they all exist
+	uniquePageSlugs()
+	createIndexes()
+}
+
+func (sqliteDialect) checkSchema(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table'`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, table := range schemaTables {
+		if !existing[table] {
+			return fmt.Errorf("table %s is missing", table)
+		}
+	}
+
+	for _, added := range addedColumns {
+		var count int
+		err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, added[0], added[1]).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("column %s.%s is missing", added[0], added[1])
+		}
+	}
+	return nil
+}
+
+func (sqliteDialect) close() {
+	if _, err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		slog.Warn("Failed to checkpoint database", "err", err)
+	}
+}
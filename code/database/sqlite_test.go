@@ -0,0 +1,162 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Opens a fresh SQLite database in a temporary directory, closed when the
+// test ends
+func openTestSQLite(tb testing.TB) string {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "postpath.db")
+	InitDB(path, 5*time.Second)
+	tb.Cleanup(func() { Close() })
+	return path
+}
+
+// Adds a user and a page of texts for the benchmarks to work on. Returns
+// the page id.
+func seedPage(tb testing.TB, texts int) int {
+	tb.Helper()
+	if _, err := db.Exec(`INSERT INTO users (id, username, email, password) VALUES (1, 'bench', 'bench@example.com', 'x')`); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO pages (id, title, slug) VALUES (2, 'bench', 'bench')`); err != nil {
+		tb.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < texts; i++ {
+		if _, err := tx.Exec(`INSERT INTO pagetext (page_id, user_id, text, created_at, path, source) VALUES (2, 1, 'text', ?, '0', 0)`, time.Now()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tb.Fatal(err)
+	}
+	return 2
+}
+
+// Pool strategies to compare: the single writer beside a read pool, and
+// the one shared pool of 25 connections with driver defaults the server
+// used to open
+var poolSetups = []struct {
+	name  string
+	setup func(tb testing.TB, path string)
+}{
+	{"split", func(tb testing.TB, path string) {}},
+	{"shared", func(tb testing.TB, path string) {
+		shared, err := sql.Open(driverName, path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		shared.SetMaxOpenConns(25)
+		writer, reader := db, readDB
+		db, readDB = shared, shared
+		tb.Cleanup(func() {
+			db, readDB = writer, reader
+			shared.Close()
+		})
+	}},
+}
+
+// Goroutines per CPU in the parallel benchmarks, enough to keep several
+// requests contending for the database even on a small machine
+const benchParallelism = 8
+
+// Reports the fraction of operations that failed, which is how "database is
+// locked" shows up
+func reportErrors(b *testing.B, failed *atomic.Int64) {
+	b.ReportMetric(float64(failed.Load())/float64(b.N), "errors/op")
+}
+
+// Nine reads of a page for every post added to it, from many goroutines
+func BenchmarkMixedReadWrite(b *testing.B) {
+	for _, pool := range poolSetups {
+		b.Run(pool.name, func(b *testing.B) {
+			path := openTestSQLite(b)
+			pageId := seedPage(b, 500)
+			pool.setup(b, path)
+			ctx := context.Background()
+
+			var ops, failed atomic.Int64
+			b.SetParallelism(benchParallelism)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if ops.Add(1)%10 == 0 {
+						_, cancel, err := ExecWithTimeout(ctx, `INSERT INTO pagetext (page_id, user_id, text, created_at, path, source) VALUES (?, 1, 'text', ?, '0', 0)`, pageId, time.Now())
+						if err != nil {
+							failed.Add(1)
+							continue
+						}
+						cancel()
+						continue
+					}
+
+					rows, cancel, err := QueryWithTimeout(ctx, `SELECT id, text, created_at FROM pagetext WHERE page_id = ? AND parent_id IS NULL ORDER BY created_at ASC`, pageId)
+					if err != nil {
+						failed.Add(1)
+						continue
+					}
+					for rows.Next() {
+					}
+					rows.Close()
+					cancel()
+				}
+			})
+			reportErrors(b, &failed)
+		})
+	}
+}
+
+// Transactions that read a row and then update it, as editing a text does.
+// Two of these upgrading from a read lock at once is what deadlocks SQLite.
+func BenchmarkReadThenWriteTx(b *testing.B) {
+	for _, pool := range poolSetups {
+		b.Run(pool.name, func(b *testing.B) {
+			path := openTestSQLite(b)
+			seedPage(b, 100)
+			pool.setup(b, path)
+			ctx := context.Background()
+
+			var ops, failed atomic.Int64
+			b.SetParallelism(benchParallelism)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					textId := ops.Add(1)%100 + 1
+					if err := readThenWrite(ctx, textId); err != nil {
+						failed.Add(1)
+					}
+				}
+			})
+			reportErrors(b, &failed)
+		})
+	}
+}
+
+func readThenWrite(ctx context.Context, textId int64) error {
+	tx, cancel, err := BeginWithTimeout(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	defer tx.Rollback()
+
+	var revision int
+	if err := tx.QueryRow(`SELECT revision FROM pagetext WHERE id = ?`, textId).Scan(&revision); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE pagetext SET revision = ? WHERE id = ?`, revision+1, textId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
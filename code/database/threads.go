@@ -0,0 +1,53 @@
+package database
+
+import "context"
+
+// Returns the owner of the profile whose thread a text belongs to: the user
+// the top-level text was left for, or else its author
+func ThreadProfile(ctx context.Context, textId int) (int, error) {
+	row, cancel := QueryRowWithTimeout(ctx, `
+		WITH RECURSIVE ancestors(id, parent_id, owner_id) AS (
+			SELECT id, parent_id, COALESCE(profile_id, user_id) FROM pagetext WHERE id = ?
+			UNION ALL
+			SELECT pagetext.id, pagetext.parent_id, COALESCE(pagetext.profile_id, pagetext.user_id)
+			FROM pagetext
+			INNER JOIN ancestors ON pagetext.id = ancestors.parent_id
+		)
+		SELECT owner_id FROM ancestors WHERE parent_id IS NULL
+	`, textId)
+	defer cancel()
+
+	var ownerId int
+	err := row.Scan(&ownerId)
+	return ownerId, err
+}
+
+// Returns the storage keys of the attachment files of a user's text on a
+// page and of every reply under it, whoever wrote the replies
+func SubtreeAttachmentKeys(ctx context.Context, pageId int, textId int, userId int) ([]string, error) {
+	rows, cancel, err := QueryWithTimeout(ctx, `
+		WITH RECURSIVE subtree(id) AS (
+			SELECT id FROM pagetext WHERE id = ? AND page_id = ? AND user_id = ?
+			UNION ALL
+			SELECT pagetext.id FROM pagetext INNER JOIN subtree ON pagetext.parent_id = subtree.id
+		)
+		SELECT attachments.storage_key, attachments.thumb_key
+		FROM attachments
+		INNER JOIN subtree ON subtree.id = attachments.text_id
+	`, textId, pageId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key, thumbKey string
+		if err := rows.Scan(&key, &thumbKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key, thumbKey)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("postpath/database")
+
+// The first table a statement reads or writes
+var statementTable = regexp.MustCompile(`(?i)\b(?:FROM|INTO|UPDATE|JOIN)\s+([a-z_][a-z0-9_]*)`)
+
+// Starts a span for a statement. Only the statement's text is recorded,
+// never its arguments, so post text and credentials stay out of traces.
+func startSpan(ctx context.Context, query string) (context.Context, trace.Span) {
+	operation := statementOperation(query)
+	return tracer.Start(ctx, statementName(query),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", current.name()),
+			attribute.String("db.operation.name", operation),
+			attribute.String("db.query.text", strings.Join(strings.Fields(query), " ")),
+		),
+	)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Names a statement by its operation and first table, e.g. "SELECT pagetext"
+func statementName(query string) string {
+	operation := statementOperation(query)
+	if match := statementTable.FindStringSubmatch(query); match != nil {
+		return operation + " " + strings.ToLower(match[1])
+	}
+	return operation
+}
+
+func statementOperation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "QUERY"
+	}
+	return strings.ToUpper(fields[0])
+}
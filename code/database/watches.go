@@ -0,0 +1,73 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// A watched page with posts the watcher has not seen
+type UnreadPage struct {
+	PageID       int
+	Title        string
+	Path         string
+	Unread       int
+	LastActivity time.Time
+}
+
+// Expands each of a user's watches through linked subpages up to its depth,
+// then counts the posts by other users newer than the user's last visit to
+// each page. Pages never visited count posts made since the watch began.
+func UnreadWatchedPages(ctx context.Context, userId int) ([]UnreadPage, error) {
+	rows, cancel, err := QueryWithTimeout(ctx, `
+		WITH RECURSIVE watched(page_id, path, depth, since) AS (
+			SELECT page_id, path, depth, created_at FROM page_watches WHERE user_id = ?
+			UNION
+			SELECT pagetext.link_id, watched.path || '/' || CAST(pagetext.link_id AS TEXT), watched.depth - 1, watched.since
+			FROM watched
+			INNER JOIN pagetext ON pagetext.page_id = watched.page_id
+			WHERE watched.depth > 0 AND pagetext.link_id IS NOT NULL
+		),
+		watched_pages AS (
+			SELECT page_id, MIN(path) AS path, MIN(since) AS since
+			FROM watched
+			GROUP BY page_id
+		)
+		SELECT
+			pages.id,
+			pages.title,
+			watched_pages.path,
+			COUNT(pagetext.id),
+			MAX(pagetext.created_at)
+		FROM watched_pages
+		INNER JOIN pages ON pages.id = watched_pages.page_id
+		INNER JOIN pagetext ON pagetext.page_id = watched_pages.page_id AND pagetext.user_id != ?
+		LEFT JOIN page_visits ON page_visits.page_id = watched_pages.page_id AND page_visits.user_id = ?
+		WHERE pagetext.created_at > COALESCE(page_visits.last_seen_at, watched_pages.since)
+		GROUP BY pages.id, pages.title, watched_pages.path
+		ORDER BY MAX(pagetext.created_at) DESC
+	`, userId, userId, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer rows.Close()
+
+	var pages []UnreadPage
+	for rows.Next() {
+		var page UnreadPage
+		var lastActivity string
+		if err := rows.Scan(&page.PageID, &page.Title, &page.Path, &page.Unread, &lastActivity); err != nil {
+			return nil, err
+		}
+		// SQLite returns aggregates as the stored text rather than as a
+		// time; PostgreSQL returns a time, which scans as RFC 3339
+		for _, layout := range []string{StoredTimeLayout, time.RFC3339Nano} {
+			if t, err := time.Parse(layout, lastActivity); err == nil {
+				page.LastActivity = t
+				break
+			}
+		}
+		pages = append(pages, page)
+	}
+	return pages, rows.Err()
+}
@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"net/mail"
 	"postpath/database"
+	"postpath/logging"
+	"postpath/metrics"
 	"regexp"
 	"strings"
 
@@ -47,7 +49,9 @@ func AuthMiddleware(next http.Handler) http.Handler {
 				}
 
 				// Continue with authenticated context
-				userID := getUserId(username)
+				userID := getUserId(r.Context(), username)
+				logging.SetUserID(r.Context(), userID)
+				metrics.UserSeen(userID)
 				ctx := context.WithValue(r.Context(), userContextKey, username)
 				ctx = context.WithValue(ctx, userIDContextKey, userID)
 				next.ServeHTTP(w, r.WithContext(ctx))
@@ -84,6 +88,10 @@ func GetUserFromContext(r *http.Request) (string, int) {
 }
 
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if !settings.Features.Registration {
+		http.Error(w, "Registration is closed", http.StatusForbidden)
+		return
+	}
 	if r.Method == http.MethodPost {
 		username := r.FormValue("username")
 		email := r.FormValue("email")
@@ -129,7 +137,7 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Insert into DB
-		_, err = database.DB().Exec(
+		_, cancel, err := database.ExecWithTimeout(r.Context(),
 			"INSERT INTO users (username, email, password) VALUES (?, ?, ?)",
 			username, email, hash,
 		)
@@ -143,6 +151,7 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 			render(w, r, "register", data)
 			return
 		}
+		cancel()
 
 		// On success, do a full-page redirect (not HTMX)
 		session, _ := store.Get(r, "session")
@@ -172,7 +181,7 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		var id int
 		var username, hash string
 
-		row, cancel := database.QueryRowWithTimeout(
+		row, cancel := database.QueryRowWithTimeout(r.Context(),
 			"SELECT id, username, password FROM users WHERE email = ?", email)
 		defer cancel()
 
@@ -240,10 +249,10 @@ func isValidSession(session *sessions.Session) bool {
 	return true
 }
 
-func getUserId(user string) int {
+func getUserId(ctx context.Context, user string) int {
 	var userId int
 
-	row, cancel := database.QueryRowWithTimeout("SELECT id FROM users WHERE username = ?", user)
+	row, cancel := database.QueryRowWithTimeout(ctx, "SELECT id FROM users WHERE username = ?", user)
 	defer cancel()
 
 	err := row.Scan(&userId)
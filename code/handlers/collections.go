@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"postpath/database"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Longest allowed collection name
+const maxCollectionNameLength = 64
+
+type Collection struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Count     int       `json:"count"`
+	CreatedAt time.Time `json:"created_at"`
+	Saved     bool      `json:"-"`
+}
+
+type Breadcrumb struct {
+	Title string
+	URL   string
+}
+
+type SavedItem struct {
+	FeedItem
+	CollectionID int
+	Breadcrumbs  []Breadcrumb
+}
+
+// Shows the collections a text can be saved to
+func SaveFormHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	textId := getTextId(r)
+	if textId == -1 {
+		htmxError(w, "TextID missing", http.StatusNotFound)
+		return
+	}
+
+	data := map[string]any{
+		"TextID":      textId,
+		"Collections": getCollections(r.Context(), userId, textId),
+	}
+	render(w, r, "saveform", data)
+}
+
+func SaveFormCancelHandler(w http.ResponseWriter, r *http.Request) {
+	render(w, r, "savebutton", map[string]any{"TextID": getTextId(r)})
+}
+
+// Saves a text to an existing collection or to a newly named one
+func SaveTextHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	textId := getTextId(r)
+	if textId == -1 || !textExists(r.Context(), textId) {
+		htmxError(w, "Text does not exist", http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		htmxError(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	var collectionId int
+	var err error
+	if name := strings.Join(strings.Fields(r.FormValue("name")), " "); name != "" {
+		if utf8.RuneCountInString(name) > maxCollectionNameLength {
+			htmxError(w, "Collection names are limited to 64 characters", http.StatusBadRequest)
+			return
+		}
+		collectionId, err = ensureCollection(r.Context(), userId, name)
+		if err != nil {
+			htmxError(w, "Failed to create collection", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		collectionId, err = strconv.Atoi(r.FormValue("collection_id"))
+		if err != nil || getCollectionName(r.Context(), userId, collectionId) == "" {
+			htmxError(w, "Choose a collection", http.StatusBadRequest)
+			return
+		}
+	}
+
+	_, cancel, err := database.ExecWithTimeout(r.Context(), `INSERT INTO collection_items (collection_id, text_id) VALUES (?, ?) ON CONFLICT DO NOTHING`, collectionId, textId)
+	if err != nil {
+		htmxError(w, "Failed to save text", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+
+	data := map[string]any{
+		"TextID":      textId,
+		"Collections": getCollections(r.Context(), userId, textId),
+		"SavedTo":     getCollectionName(r.Context(), userId, collectionId),
+	}
+	render(w, r, "saveform", data)
+}
+
+// Lists the user's collections
+func SavedHandler(w http.ResponseWriter, r *http.Request) {
+	user, userId := GetUserFromContext(r)
+
+	data := map[string]any{
+		"Username":    user,
+		"LoggedIn":    user != "",
+		"Collections": getCollections(r.Context(), userId, 0),
+	}
+	render(w, r, "saved", data)
+}
+
+// Shows the texts saved in one collection
+func CollectionHandler(w http.ResponseWriter, r *http.Request) {
+	user, userId := GetUserFromContext(r)
+
+	collectionId := getCollectionId(r)
+	name := getCollectionName(r.Context(), userId, collectionId)
+	if name == "" {
+		htmxError(w, "Collection does not exist", http.StatusNotFound)
+		return
+	}
+
+	data := map[string]any{
+		"Username":     user,
+		"LoggedIn":     user != "",
+		"CollectionID": collectionId,
+		"Name":         name,
+		"Items":        getSavedItems(r.Context(), collectionId),
+	}
+	render(w, r, "collection", data)
+}
+
+func DeleteCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	collectionId := getCollectionId(r)
+	if getCollectionName(r.Context(), userId, collectionId) == "" {
+		htmxError(w, "Collection does not exist", http.StatusNotFound)
+		return
+	}
+
+	_, cancel, err := database.ExecWithTimeout(r.Context(), `DELETE FROM collection_items WHERE collection_id = ?`, collectionId)
+	if err != nil {
+		htmxError(w, "Failed to delete collection", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+	_, cancel, err = database.ExecWithTimeout(r.Context(), `DELETE FROM collections WHERE id = ? AND user_id = ?`, collectionId, userId)
+	if err != nil {
+		htmxError(w, "Failed to delete collection", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+
+	w.Header().Set("HX-Location", "/saved")
+	w.WriteHeader(http.StatusOK)
+}
+
+func RemoveSavedTextHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	collectionId := getCollectionId(r)
+	if getCollectionName(r.Context(), userId, collectionId) == "" {
+		htmxError(w, "Collection does not exist", http.StatusNotFound)
+		return
+	}
+
+	_, cancel, err := database.ExecWithTimeout(r.Context(), `DELETE FROM collection_items WHERE collection_id = ? AND text_id = ?`, collectionId, getTextId(r))
+	if err != nil {
+		htmxError(w, "Failed to remove text", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+	w.WriteHeader(http.StatusOK)
+}
+
+// Lists the user's collections as JSON
+func CollectionsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	collections := getCollections(r.Context(), userId, 0)
+	if collections == nil {
+		collections = []Collection{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(collections); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode collections", "err", err)
+	}
+}
+
+// Helper Functions
+
+// Returns the user's collections with their text counts. When textId is set,
+// each collection also records whether it already holds that text.
+func getCollections(ctx context.Context, userId int, textId int) []Collection {
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT
+			collections.id,
+			collections.name,
+			collections.created_at,
+			COUNT(pagetext.id),
+			COALESCE(SUM(CASE WHEN pagetext.id = ? THEN 1 ELSE 0 END), 0)
+		FROM collections
+		LEFT JOIN collection_items ON collection_items.collection_id = collections.id
+		LEFT JOIN pagetext ON pagetext.id = collection_items.text_id
+		WHERE collections.user_id = ?
+		GROUP BY collections.id, collections.name, collections.created_at
+		ORDER BY collections.name
+	`, textId, userId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query collections", "user_id", userId, "err", err)
+		return nil
+	}
+	defer cancel()
+	defer rows.Close()
+
+	var collections []Collection
+	for rows.Next() {
+		var c Collection
+		var saved int
+		if err := rows.Scan(&c.ID, &c.Name, &c.CreatedAt, &c.Count, &saved); err != nil {
+			continue
+		}
+		c.Saved = saved > 0
+		collections = append(collections, c)
+	}
+	return collections
+}
+
+// Returns the id of the user's collection with this name, creating it if needed
+func ensureCollection(ctx context.Context, userId int, name string) (int, error) {
+	_, cancel, err := database.ExecWithTimeout(ctx, `INSERT INTO collections (user_id, name) VALUES (?, ?) ON CONFLICT DO NOTHING`, userId, name)
+	if err != nil {
+		return 0, err
+	}
+	cancel()
+
+	var id int
+	row, cancel := database.QueryRowWithTimeout(ctx, `SELECT id FROM collections WHERE user_id = ? AND name = ?`, userId, name)
+	defer cancel()
+	err = row.Scan(&id)
+	return id, err
+}
+
+// Returns the collection's name, or "" if the user does not own it
+func getCollectionName(ctx context.Context, userId int, collectionId int) string {
+	var name string
+
+	row, cancel := database.QueryRowWithTimeout(ctx, `SELECT name FROM collections WHERE id = ? AND user_id = ?`, collectionId, userId)
+	defer cancel()
+
+	if err := row.Scan(&name); err != nil {
+		return ""
+	}
+	return name
+}
+
+func textExists(ctx context.Context, textId int) bool {
+	var count int
+
+	row, cancel := database.QueryRowWithTimeout(ctx, `SELECT COUNT(*) FROM pagetext WHERE id = ?`, textId)
+	defer cancel()
+
+	if err := row.Scan(&count); err != nil {
+		return false
+	}
+	return count > 0
+}
+
+// Returns a collection's texts, most recently saved first
+func getSavedItems(ctx context.Context, collectionId int) []SavedItem {
+	rows, cancel, err := database.QueryWithTimeout(ctx, feedItemColumns+`
+		FROM collection_items
+		INNER JOIN pagetext ON pagetext.id = collection_items.text_id
+	`+feedItemJoins+`
+		WHERE collection_items.collection_id = ?
+		ORDER BY collection_items.created_at DESC, pagetext.id DESC
+	`, collectionId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query saved texts", "collection_id", collectionId, "err", err)
+		return nil
+	}
+	defer cancel()
+	defer rows.Close()
+
+	var items []SavedItem
+	for rows.Next() {
+		item, err := scanFeedItem(rows)
+		if err != nil {
+			continue
+		}
+		items = append(items, SavedItem{FeedItem: item, CollectionID: collectionId, Breadcrumbs: item.breadcrumbs(ctx)})
+	}
+
+	texts := make([]*PageText, len(items))
+	for i := range items {
+		texts[i] = &items[i].PageText
+	}
+	addMentions(ctx, texts)
+	return items
+}
+
+// Returns the titles and links for each step of a page path
+func getBreadcrumbs(ctx context.Context, path []int) []Breadcrumb {
+	titles, err := getPageTitles(ctx, path)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query page titles", "path", joinPath(path), "err", err)
+		return nil
+	}
+	var breadcrumbs []Breadcrumb
+	for i, id := range path {
+		title, ok := titles[id]
+		if !ok {
+			continue
+		}
+		breadcrumbs = append(breadcrumbs, Breadcrumb{Title: title, URL: "/page/" + joinPath(path[:i+1])})
+	}
+	return breadcrumbs
+}
+
+func getCollectionId(r *http.Request) int {
+	id, err := strconv.Atoi(mux.Vars(r)["collectionId"])
+	if err != nil {
+		return -1
+	}
+	return id
+}
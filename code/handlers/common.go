@@ -1,31 +1,62 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"path"
+	"postpath/config"
+	"postpath/metrics"
+	"postpath/tracing"
+	"time"
 
 	"github.com/gorilla/sessions"
 )
 
 var (
-	tpl   *template.Template
-	store *sessions.CookieStore
+	tpl      *template.Template
+	store    *sessions.CookieStore
+	settings = config.Default()
 )
 
-func SetupHelpers(templateGlob string, sessionKey []byte) {
-	tpl = template.Must(template.ParseGlob(templateGlob))
+// Settings are exposed as functions so every fragment sees the same limits
+// without each handler passing them along
+var templateFuncs = template.FuncMap{
+	"renderText":     renderText,
+	"maxPostLength":  func() int { return settings.MaxPostLength },
+	"uploadsEnabled": func() bool { return settings.Features.Uploads },
+	"canRegister":    func() bool { return settings.Features.Registration },
+}
+
+func SetupHelpers(templateGlob string, sessionKey []byte, cfg config.Config) {
+	settings = cfg
+	tpl = template.Must(template.New("").Funcs(templateFuncs).ParseGlob(templateGlob))
 	store = sessions.NewCookieStore(sessionKey)
 	store.Options = &sessions.Options{
 		Path:     "/",
-		MaxAge:   3600 * 24, // 1 day
+		MaxAge:   int(cfg.SessionLifetime.Seconds()),
 		HttpOnly: true,
 		Secure:   true, // Changed to true for HTTPS
 		SameSite: http.SameSiteStrictMode,
 	}
 }
 
+// Confirms the templates were parsed, including the ones every page needs
+func CheckTemplates(ctx context.Context) (map[string]any, error) {
+	if tpl == nil {
+		return nil, errors.New("templates are not loaded")
+	}
+	for _, name := range []string{"baseheader", "basefooter", "home", "homeHTMX", "landing"} {
+		if tpl.Lookup(name) == nil {
+			return nil, fmt.Errorf("template %s is missing", name)
+		}
+	}
+	return map[string]any{"count": len(tpl.Templates())}, nil
+}
+
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	render(w, r, "landing", nil)
 }
@@ -37,10 +68,17 @@ func render(w http.ResponseWriter, r *http.Request, page string, data map[string
 	}
 	if isHTMX(r) {
 		tplName += "HTMX"
+	} else if _, userId := GetUserFromContext(r); userId > 0 {
+		// Full pages include the top nav and its notification bell
+		data["UnreadCount"] = unreadNotificationCount(r.Context(), userId)
 	}
-	log.Println("Rendering " + tplName)
+	slog.DebugContext(r.Context(), "Rendering template", "template", tplName)
 	if tpl.Lookup(tplName) != nil {
+		start := time.Now()
+		_, span := tracing.StartRender(r.Context(), tplName)
 		tpl.ExecuteTemplate(w, tplName, data)
+		span.End()
+		metrics.ObserveRender(tplName, start)
 	} else if !isHTMX(r) {
 		http.Redirect(w, r, "/home", http.StatusSeeOther)
 	}
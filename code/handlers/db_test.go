@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"path/filepath"
+	"postpath/database"
+	"testing"
+	"time"
+)
+
+// Opens a fresh database in a temporary directory, closed when the test
+// ends, and looks up its home and profile pages. Titles cached from an
+// earlier test's database are dropped.
+func openTestDB(tb testing.TB) {
+	tb.Helper()
+	database.InitDB(filepath.Join(tb.TempDir(), "postpath.db"), 5*time.Second)
+	HandlerInit()
+	titleCache = newTitleLRU(maxTitleCacheEntries)
+	tb.Cleanup(func() { database.Close() })
+}
+
+// Adds a user, returning its id
+func createTestUser(tb testing.TB, username string) int {
+	tb.Helper()
+	var id int
+	err := database.DB().QueryRow(
+		`INSERT INTO users (username, email, password) VALUES (?, ?, 'x') RETURNING id`,
+		username, username+"@example.com",
+	).Scan(&id)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return id
+}
+
+// Adds a page, returning its id
+func createTestPage(tb testing.TB, title string) int {
+	tb.Helper()
+	var id int
+	err := database.DB().QueryRow(
+		`INSERT INTO pages (title, slug) VALUES (?, ?) RETURNING id`,
+		title, database.Slugify(title),
+	).Scan(&id)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return id
+}
+
+// Adds a text to a page, replying to parentId unless it is zero, and
+// returns its id
+func createTestText(tb testing.TB, pageId int, userId int, parentId int) int {
+	tb.Helper()
+	var parent any
+	if parentId > 0 {
+		parent = parentId
+	}
+	var id int
+	err := database.DB().QueryRow(
+		`INSERT INTO pagetext (page_id, user_id, text, created_at, path, source, parent_id) VALUES (?, ?, 'text', ?, '0', 0, ?) RETURNING id`,
+		pageId, userId, time.Now(), parent,
+	).Scan(&id)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return id
+}
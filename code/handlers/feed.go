@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"postpath/database"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type FeedItem struct {
+	PageText
+	PageTitle string
+	PageURL   string
+}
+
+func FeedHandler(w http.ResponseWriter, r *http.Request) {
+	user, userId := GetUserFromContext(r)
+
+	items, before := getFeed(r.Context(), userId, 0)
+	data := map[string]any{
+		"Username": user,
+		"LoggedIn": user != "",
+		"Items":    items,
+		"Before":   before,
+	}
+	render(w, r, "feed", data)
+}
+
+// Loads the next page of the feed, older than the "before" text id
+func FeedPageHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	before, err := strconv.Atoi(r.URL.Query().Get("before"))
+	if err != nil || before <= 0 {
+		htmxError(w, "Invalid feed cursor", http.StatusBadRequest)
+		return
+	}
+
+	items, next := getFeed(r.Context(), userId, before)
+	data := map[string]any{
+		"Items":  items,
+		"Before": next,
+	}
+	render(w, r, "feedpage", data)
+}
+
+func FollowHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	followeeId := getFolloweeId(r)
+	if followeeId == -1 || followeeId == userId || getUsername(r.Context(), followeeId) == "" {
+		htmxError(w, "You cannot follow this user.", http.StatusBadRequest)
+		return
+	}
+
+	_, cancel, err := database.ExecWithTimeout(r.Context(), `INSERT INTO follows (follower_id, followee_id) VALUES (?, ?) ON CONFLICT DO NOTHING`, userId, followeeId)
+	if err != nil {
+		htmxError(w, "Failed to follow user", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+
+	render(w, r, "followbutton", map[string]any{"ProfileID": followeeId, "Following": true})
+}
+
+func UnfollowHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	followeeId := getFolloweeId(r)
+	if followeeId == -1 {
+		htmxError(w, "UserID missing", http.StatusNotFound)
+		return
+	}
+
+	_, cancel, err := database.ExecWithTimeout(r.Context(), `DELETE FROM follows WHERE follower_id = ? AND followee_id = ?`, userId, followeeId)
+	if err != nil {
+		htmxError(w, "Failed to unfollow user", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+
+	render(w, r, "followbutton", map[string]any{"ProfileID": followeeId, "Following": false})
+}
+
+// Helper Functions
+
+// Columns a FeedItem is scanned from, and the joins they need beside
+// pagetext. Profile posts are shown on the profile they were left on.
+const feedItemColumns = `
+	SELECT
+		pagetext.page_id,
+		pagetext.id,
+		pagetext.text,
+		pagetext.link_id,
+		users.id,
+		users.username,
+		pagetext.created_at,
+		pagetext.is_edited,
+		COALESCE(pagetext.path, ''),
+		COALESCE(pagetext.source, 0),
+		COALESCE(source_pages.title, ''),
+		pagetext.revision,
+		pages.title,
+		profile_owners.id,
+		profile_owners.username
+`
+
+const feedItemJoins = `
+	INNER JOIN users ON pagetext.user_id = users.id
+	INNER JOIN pages ON pagetext.page_id = pages.id
+	INNER JOIN users AS profile_owners ON profile_owners.id = COALESCE(pagetext.profile_id, pagetext.user_id)
+	LEFT JOIN pages AS source_pages ON pagetext.source = source_pages.id
+`
+
+// Returns recent texts by followed users, newest first, and the cursor for
+// the next page. Paging is by text id so new posts never shift a page.
+func getFeed(ctx context.Context, userId int, before int) ([]FeedItem, int) {
+	rows, cancel, err := database.QueryWithTimeout(ctx, feedItemColumns+`
+		FROM pagetext
+		INNER JOIN follows ON follows.followee_id = pagetext.user_id AND follows.follower_id = ?
+	`+feedItemJoins+`
+		WHERE ? = 0 OR pagetext.id < ?
+		ORDER BY pagetext.id DESC
+		LIMIT ?
+	`, userId, before, before, settings.PageSize)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query feed", "user_id", userId, "err", err)
+		return nil, 0
+	}
+	defer cancel()
+	defer rows.Close()
+
+	var items []FeedItem
+	for rows.Next() {
+		if item, err := scanFeedItem(rows); err == nil {
+			items = append(items, item)
+		}
+	}
+
+	texts := make([]*PageText, len(items))
+	for i := range items {
+		texts[i] = &items[i].PageText
+	}
+	addMentions(ctx, texts)
+
+	// A short page means there is nothing older to load
+	next := 0
+	if len(items) == settings.PageSize {
+		next = items[len(items)-1].TextID
+	}
+	return items, next
+}
+
+func scanFeedItem(rows *sql.Rows) (FeedItem, error) {
+	var item FeedItem
+	var linkId sql.NullInt64
+	var createdAt time.Time
+	var profileId int
+	var profileOwner string
+
+	if err := rows.Scan(
+		&item.PageID, &item.TextID, &item.Text, &linkId, &item.UserID, &item.User,
+		&createdAt, &item.Edited, &item.SourcePath, &item.Source, &item.SourceTitle,
+		&item.Revision, &item.PageTitle, &profileId, &profileOwner,
+	); err != nil {
+		return item, err
+	}
+	if linkId.Valid {
+		item.LinkID = int(linkId.Int64)
+	}
+	item.CreatedAtStr = createdAt.Format("2006-01-02 15:04")
+
+	if item.PageID == ProfilePageID {
+		item.PageTitle = "@" + profileOwner
+		item.PageURL = "/profile/" + strconv.Itoa(profileId)
+	} else {
+		fullPath := pagePath(item.SourcePath, item.PageID)
+		item.Path = parsePath(fullPath)
+		item.PageURL = "/page/" + fullPath
+	}
+	return item, nil
+}
+
+// Returns the titles and links for each step to the item's page
+func (item FeedItem) breadcrumbs(ctx context.Context) []Breadcrumb {
+	if item.PageID == ProfilePageID {
+		return []Breadcrumb{{Title: item.PageTitle, URL: item.PageURL}}
+	}
+	return getBreadcrumbs(ctx, item.Path)
+}
+
+func isFollowing(ctx context.Context, followerId int, followeeId int) bool {
+	var count int
+
+	row, cancel := database.QueryRowWithTimeout(ctx, `SELECT COUNT(*) FROM follows WHERE follower_id = ? AND followee_id = ?`, followerId, followeeId)
+	defer cancel()
+
+	if err := row.Scan(&count); err != nil {
+		return false
+	}
+	return count > 0
+}
+
+func getFolloweeId(r *http.Request) int {
+	id, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		return -1
+	}
+	return id
+}
+
+// Parses a stored path such as "0/4/7" into page ids
+func parsePath(rawPath string) []int {
+	var ids []int
+	for _, s := range strings.Split(rawPath, "/") {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return nil
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
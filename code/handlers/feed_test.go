@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"context"
+	"postpath/database"
+	"strconv"
+	"testing"
+)
+
+// A post left on someone else's profile links to that profile in the feed
+// and among saved texts, not to its author's
+func TestProfilePostPage(t *testing.T) {
+	openTestDB(t)
+	owner := createTestUser(t, "owner")
+	author := createTestUser(t, "author")
+	reader := createTestUser(t, "reader")
+	textId := createTestText(t, ProfilePageID, author, 0)
+	if _, err := database.DB().Exec(`UPDATE pagetext SET profile_id = ? WHERE id = ?`, owner, textId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.DB().Exec(`INSERT INTO follows (follower_id, followee_id) VALUES (?, ?)`, reader, author); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	collectionId, err := ensureCollection(ctx, reader, "saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.DB().Exec(`INSERT INTO collection_items (collection_id, text_id) VALUES (?, ?)`, collectionId, textId); err != nil {
+		t.Fatal(err)
+	}
+	wantURL := "/profile/" + strconv.Itoa(owner)
+
+	feed, _ := getFeed(ctx, reader, 0)
+	if len(feed) != 1 {
+		t.Fatalf("%d feed items, want 1", len(feed))
+	}
+	if feed[0].PageTitle != "@owner" || feed[0].PageURL != wantURL {
+		t.Errorf("feed item on %q at %s, want @owner at %s", feed[0].PageTitle, feed[0].PageURL, wantURL)
+	}
+
+	saved := getSavedItems(ctx, collectionId)
+	if len(saved) != 1 {
+		t.Fatalf("%d saved items, want 1", len(saved))
+	}
+	if saved[0].PageURL != wantURL || len(saved[0].Breadcrumbs) != 1 || saved[0].Breadcrumbs[0].Title != "@owner" {
+		t.Errorf("saved item at %s with breadcrumbs %v, want @owner at %s", saved[0].PageURL, saved[0].Breadcrumbs, wantURL)
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"html"
+	"net/http"
+	"net/url"
+	"postpath/database"
+	"postpath/metrics"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matches inline page references such as [[machine learning]]
+var linkPattern = regexp.MustCompile(`\[\[([^\[\]\n]+)\]\]`)
+
+var linkArrows = []string{"→", "->"}
+
+// Resolves an inline page reference and opens it below the current path
+func LinkHandler(w http.ResponseWriter, r *http.Request) {
+	user, userId := GetUserFromContext(r)
+
+	path := getPath(r)
+	// Profiles are not part of any page's path, so references made on one
+	// open a path of their own
+	if path == nil || path[0] == ProfilePageID {
+		path = nil
+	}
+
+	title := normalizeTitle(r.URL.Query().Get("title"))
+	if title == "" {
+		htmxError(w, "Link title missing", http.StatusBadRequest)
+		return
+	}
+
+	linkId, err := lookupPageId(r.Context(), title)
+	if err == sql.ErrNoRows {
+		htmxError(w, "Page does not exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		htmxError(w, "Failed to query pages", http.StatusInternalServerError)
+		return
+	}
+
+	path = append(path, linkId)
+	pageURL := "/page/" + joinPath(path)
+	if !isHTMX(r) {
+		http.Redirect(w, r, pageURL, http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("HX-Push-Url", pageURL)
+	renderPage(w, r, path, user, userId, true, false)
+}
+
+// Returns the page title a post links to, if the whole post is a link.
+// A single word, [[a title]] or a leading arrow (→ a title) all make links.
+func parseLink(text string) (string, bool) {
+	if match := linkPattern.FindStringSubmatch(text); match != nil && match[0] == text {
+		title := normalizeTitle(match[1])
+		return title, title != ""
+	}
+
+	for _, arrow := range linkArrows {
+		if rest, ok := strings.CutPrefix(text, arrow); ok {
+			title := normalizeTitle(rest)
+			return title, title != ""
+		}
+	}
+
+	// A lone @username is a mention rather than a page
+	if len(strings.Fields(text)) == 1 && mentionPattern.FindString(text) != text {
+		return normalizeTitle(text), true
+	}
+
+	return "", false
+}
+
+// Returns the titles of every inline page reference in a post
+func inlineLinks(text string) []string {
+	var titles []string
+	for _, match := range linkPattern.FindAllStringSubmatch(text, -1) {
+		if title := normalizeTitle(match[1]); title != "" {
+			titles = append(titles, title)
+		}
+	}
+	return titles
+}
+
+// Page titles are lowercased with whitespace collapsed
+func normalizeTitle(title string) string {
+	return strings.Join(strings.Fields(strings.ToLower(title)), " ")
+}
+
+// Returns the id of the page with this title, creating it if needed
+func ensurePage(ctx context.Context, title string, userId int) (int, error) {
+	pageId, err := lookupPageId(ctx, title)
+	if err != sql.ErrNoRows {
+		return pageId, err
+	}
+
+	// Slugs are unique, so a page created meanwhile under a title with the
+	// same slug wins and is looked up again
+	row, cancel := database.QueryRowWithTimeout(ctx, `
+		INSERT INTO pages (title, slug, owner_id) VALUES (?, ?, ?)
+		ON CONFLICT(slug) DO NOTHING
+		RETURNING id
+	`, title, database.Slugify(title), userId)
+	defer cancel()
+	err = row.Scan(&pageId)
+	if err == sql.ErrNoRows {
+		return lookupPageId(ctx, title)
+	} else if err != nil {
+		return 0, err
+	}
+	metrics.PageCreated()
+	return pageId, nil
+}
+
+// Makes sure every page referenced inline in a post exists and returns
+// their ids
+func ensureInlinePages(ctx context.Context, text string, userId int) ([]int, error) {
+	var pageIds []int
+	for _, title := range inlineLinks(text) {
+		pageId, err := ensurePage(ctx, title, userId)
+		if err != nil {
+			return nil, err
+		}
+		pageIds = append(pageIds, pageId)
+	}
+	return pageIds, nil
+}
+
+// Renders an inline page reference as a link below the current path
+func pageLinkHTML(label string, linkPath string) string {
+	title := normalizeTitle(label)
+	if title == "" {
+		return html.EscapeString("[[" + label + "]]")
+	}
+	return `<a class="inline-link" href="/link/` + linkPath + `?title=` + url.QueryEscape(title) + `">` + html.EscapeString(strings.TrimSpace(label)) + `</a>`
+}
+
+func joinPath(path []int) string {
+	segments := make([]string, len(path))
+	for i, id := range path {
+		segments[i] = strconv.Itoa(id)
+	}
+	return strings.Join(segments, "/")
+}
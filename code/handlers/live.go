@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"postpath/metrics"
+	"postpath/tracing"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the server-sent events a page listens for
+const (
+	EventAppend = "append"
+	EventUpdate = "update"
+)
+
+// How often an idle event stream is pinged to keep proxies from closing it
+const eventKeepAlive = 30 * time.Second
+
+// Events buffered per subscriber before slow subscribers start missing them
+const eventBufferSize = 16
+
+type pageEvent struct {
+	Name   string
+	Data   string
+	UserID int
+}
+
+// In-process pub/sub of rendered fragments keyed by page ID
+type pageHub struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan pageEvent]bool
+	// Closed when the server shuts down so open streams end
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var hub = &pageHub{
+	subscribers: map[int]map[chan pageEvent]bool{},
+	closed:      make(chan struct{}),
+}
+
+func (h *pageHub) subscribe(pageId int) chan pageEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events := make(chan pageEvent, eventBufferSize)
+	if h.subscribers[pageId] == nil {
+		h.subscribers[pageId] = map[chan pageEvent]bool{}
+	}
+	h.subscribers[pageId][events] = true
+	metrics.SubscriberAdded()
+	return events
+}
+
+func (h *pageHub) unsubscribe(pageId int, events chan pageEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers[pageId], events)
+	metrics.SubscriberRemoved()
+	if len(h.subscribers[pageId]) == 0 {
+		delete(h.subscribers, pageId)
+	}
+}
+
+// Sends an event to everyone watching a page without blocking on slow readers
+func (h *pageHub) publish(pageId int, event pageEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for events := range h.subscribers[pageId] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// Ends every open event stream. Streams never finish on their own, so the
+// server cannot drain its requests until they are closed.
+func CloseEventStreams() {
+	hub.closeOnce.Do(func() {
+		close(hub.closed)
+	})
+}
+
+// Streams other users' changes to a page as server-sent events
+func PageEventsHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+	pageId := getPageId(r)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	// The stream outlives the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.WarnContext(r.Context(), "Failed to clear write deadline", "page_id", pageId, "err", err)
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := hub.subscribe(pageId)
+	defer hub.unsubscribe(pageId, events)
+
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-hub.closed:
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case event := <-events:
+			if event.UserID == userId {
+				// The author's own page already shows the change
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\n", event.Name)
+			for _, line := range strings.Split(event.Data, "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprint(w, "\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// Helper Functions
+
+// Renders a fragment and publishes it to a page's subscribers
+func publishFragment(ctx context.Context, pageId int, userId int, name string, page string, data map[string]any) {
+	var buf bytes.Buffer
+	start := time.Now()
+	_, span := tracing.StartRender(ctx, page+"HTMX")
+	err := tpl.ExecuteTemplate(&buf, page+"HTMX", data)
+	span.End()
+	metrics.ObserveRender(page+"HTMX", start)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to render fragment", "template", page, "page_id", pageId, "err", err)
+		return
+	}
+	hub.publish(pageId, pageEvent{Name: name, Data: buf.String(), UserID: userId})
+}
+
+// Removes a text and its replies from everyone watching a page
+func publishRemoval(pageId int, userId int, textId int) {
+	data := fmt.Sprintf(`<div id="thread-%d" hx-swap-oob="delete"></div>`, textId)
+	hub.publish(pageId, pageEvent{Name: EventUpdate, Data: data, UserID: userId})
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// Rendered posts kept in memory before the cache is reset
+const maxRenderCacheEntries = 5000
+
+var (
+	fencePattern      = regexp.MustCompile("^```")
+	quotePattern      = regexp.MustCompile(`^>\s?`)
+	bulletPattern     = regexp.MustCompile(`^[-*+]\s+`)
+	orderedPattern    = regexp.MustCompile(`^\d+[.)]\s+`)
+	inlineCodePattern = regexp.MustCompile("`[^`\n]+`")
+	urlPattern        = regexp.MustCompile(`https?://[^\s<>"]*[^\s<>".,:;!?'()\[\]]`)
+	strongPattern     = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
+	emPattern         = regexp.MustCompile(`\*([^*\n]+)\*`)
+	underscorePattern = regexp.MustCompile(`(^|[^\p{L}\p{N}_])_([^_\n]+)_($|[^\p{L}\p{N}_])`)
+
+	// Everything inline that is rendered as a unit rather than as plain text
+	tokenPattern = regexp.MustCompile(strings.Join([]string{
+		inlineCodePattern.String(),
+		linkPattern.String(),
+		urlPattern.String(),
+		mentionPattern.String(),
+	}, "|"))
+)
+
+// Only the tags the markdown subset produces survive sanitization
+var sanitizer = newSanitizer()
+
+var renderCache = struct {
+	sync.Mutex
+	entries map[renderKey]template.HTML
+}{entries: map[renderKey]template.HTML{}}
+
+// Inline links depend on the path the post is viewed from. Mentions are
+// saved with each revision, so they need no part in the key.
+type renderKey struct {
+	TextID   int
+	Revision int
+	Path     string
+}
+
+func newSanitizer() *bluemonday.Policy {
+	policy := bluemonday.NewPolicy()
+	policy.AllowElements("p", "br", "em", "strong", "code", "pre", "ul", "ol", "li", "blockquote")
+	policy.AllowAttrs("href").OnElements("a")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^(inline-link|mention)$`)).OnElements("a")
+	policy.AllowRelativeURLs(true)
+	policy.AllowURLSchemes("http", "https")
+	policy.RequireNoFollowOnFullyQualifiedLinks(true)
+	policy.AddTargetBlankToFullyQualifiedLinks(true)
+	return policy
+}
+
+// Renders a post's markdown to sanitized HTML, cached per text revision.
+// mentions holds the users the revision was saved as mentioning.
+func renderText(textId int, revision int, text string, path []int, pageId int, mentions map[string]int) template.HTML {
+	if len(path) == 0 {
+		path = []int{pageId}
+		if pageId != HomePageID {
+			path = []int{HomePageID, pageId}
+		}
+	}
+	linkPath := joinPath(path)
+	key := renderKey{TextID: textId, Revision: revision, Path: linkPath}
+
+	if textId > 0 {
+		renderCache.Lock()
+		rendered, ok := renderCache.entries[key]
+		renderCache.Unlock()
+		if ok {
+			return rendered
+		}
+	}
+
+	rendered := template.HTML(sanitizer.Sanitize(renderMarkdown(text, linkPath, mentions)))
+	if rendered == "" {
+		// Fall back to the raw text rather than showing an empty post
+		rendered = template.HTML("<p>" + html.EscapeString(text) + "</p>")
+	}
+
+	if textId > 0 {
+		renderCache.Lock()
+		if len(renderCache.entries) >= maxRenderCacheEntries {
+			renderCache.entries = map[renderKey]template.HTML{}
+		}
+		renderCache.entries[key] = rendered
+		renderCache.Unlock()
+	}
+
+	return rendered
+}
+
+// Renders the supported markdown subset: paragraphs, fenced code, quotes,
+// bullet and numbered lists, plus inline emphasis, code, links, URLs and
+// mentions
+func renderMarkdown(text string, linkPath string, mentions map[string]int) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	var b strings.Builder
+	for i := 0; i < len(lines); {
+		line := lines[i]
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case fencePattern.MatchString(line):
+			i++
+			var code []string
+			for i < len(lines) && !fencePattern.MatchString(lines[i]) {
+				code = append(code, lines[i])
+				i++
+			}
+			i++ // closing fence
+			b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>")
+
+		case quotePattern.MatchString(line):
+			var quoted []string
+			for i < len(lines) && quotePattern.MatchString(lines[i]) {
+				quoted = append(quoted, quotePattern.ReplaceAllString(lines[i], ""))
+				i++
+			}
+			b.WriteString("<blockquote>" + renderMarkdown(strings.Join(quoted, "\n"), linkPath, mentions) + "</blockquote>")
+
+		case bulletPattern.MatchString(line), orderedPattern.MatchString(line):
+			marker, tag := bulletPattern, "ul"
+			if !bulletPattern.MatchString(line) {
+				marker, tag = orderedPattern, "ol"
+			}
+			b.WriteString("<" + tag + ">")
+			for i < len(lines) && marker.MatchString(lines[i]) {
+				b.WriteString("<li>" + renderInline(marker.ReplaceAllString(lines[i], ""), linkPath, mentions) + "</li>")
+				i++
+			}
+			b.WriteString("</" + tag + ">")
+
+		default:
+			var paragraph []string
+			for i < len(lines) && strings.TrimSpace(lines[i]) != "" && !startsBlock(lines[i]) {
+				paragraph = append(paragraph, renderInline(lines[i], linkPath, mentions))
+				i++
+			}
+			b.WriteString("<p>" + strings.Join(paragraph, "<br>") + "</p>")
+		}
+	}
+
+	return b.String()
+}
+
+func startsBlock(line string) bool {
+	return fencePattern.MatchString(line) ||
+		quotePattern.MatchString(line) ||
+		bulletPattern.MatchString(line) ||
+		orderedPattern.MatchString(line)
+}
+
+// Renders a single line, treating code spans, page links, URLs and mentions
+// as units
+func renderInline(line string, linkPath string, mentions map[string]int) string {
+	var b strings.Builder
+	last := 0
+	for _, match := range tokenPattern.FindAllStringIndex(line, -1) {
+		if line[match[0]] == '@' && !isMentionStart(line, match[0]) {
+			continue
+		}
+		b.WriteString(renderEmphasis(line[last:match[0]]))
+		b.WriteString(renderToken(line[match[0]:match[1]], linkPath, mentions))
+		last = match[1]
+	}
+	b.WriteString(renderEmphasis(line[last:]))
+	return b.String()
+}
+
+func renderToken(token string, linkPath string, mentions map[string]int) string {
+	switch {
+	case strings.HasPrefix(token, "`"):
+		return "<code>" + html.EscapeString(strings.Trim(token, "`")) + "</code>"
+	case strings.HasPrefix(token, "[["):
+		return pageLinkHTML(linkPattern.FindStringSubmatch(token)[1], linkPath)
+	case strings.HasPrefix(token, "@"):
+		return mentionHTML(token, mentions)
+	default:
+		escaped := html.EscapeString(token)
+		return `<a href="` + escaped + `">` + escaped + `</a>`
+	}
+}
+
+// Escapes plain text, then wraps emphasis markers, which escaping leaves alone
+func renderEmphasis(text string) string {
+	escaped := html.EscapeString(text)
+	escaped = strongPattern.ReplaceAllString(escaped, "<strong>$1</strong>")
+	escaped = emPattern.ReplaceAllString(escaped, "<em>$1</em>")
+	escaped = underscorePattern.ReplaceAllString(escaped, "$1<em>$2</em>$3")
+	return escaped
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+// Markdown renders to HTML that can carry no script, whatever the post holds
+func TestRenderTextSanitizes(t *testing.T) {
+	openTestDB(t)
+
+	tests := []struct {
+		name     string
+		text     string
+		contains []string
+		excludes []string
+	}{
+		{
+			"script tag",
+			`<script>alert(1)</script>`,
+			[]string{"&lt;script&gt;alert(1)&lt;/script&gt;"},
+			[]string{"<script"},
+		},
+		{
+			"event handler attribute",
+			`<img src=x onerror=alert(1)>`,
+			[]string{"&lt;img"},
+			[]string{"<img"},
+		},
+		{
+			"raw javascript link",
+			`<a href="javascript:alert(1)">click</a>`,
+			nil,
+			[]string{"<a", `href="javascript`},
+		},
+		{
+			"javascript url as text",
+			`javascript:alert(1)`,
+			[]string{"<p>javascript:alert(1)</p>"},
+			[]string{"<a"},
+		},
+		{
+			"quote breaking out of a url",
+			`https://example.com/"onmouseover="alert(1)`,
+			[]string{`<a href="https://example.com/"`, `rel="nofollow`, `target="_blank"`},
+			[]string{`onmouseover="`},
+		},
+		{
+			"page link label",
+			`[[<b onclick="x">Fruit</b>]]`,
+			[]string{`class="inline-link"`, "&lt;b onclick="},
+			[]string{"<b ", `onclick="x"`},
+		},
+		{
+			"html in a code block",
+			"```\n<script>alert(1)</script>\n<iframe src=\"x\"></iframe>\n```",
+			[]string{"<pre><code>&lt;script&gt;alert(1)&lt;/script&gt;\n&lt;iframe"},
+			[]string{"<script", "<iframe"},
+		},
+		{
+			"html in inline code",
+			"run `<script>alert(1)</script>` now",
+			[]string{"<code>&lt;script&gt;"},
+			[]string{"<script"},
+		},
+		{
+			"html in a quote",
+			"> <script>alert(1)</script>\n> <style>body{}</style>",
+			[]string{"<blockquote>", "&lt;script&gt;", "&lt;style&gt;"},
+			[]string{"<script", "<style"},
+		},
+		{
+			"html in a list",
+			"- <svg onload=alert(1)>",
+			[]string{"<ul><li>&lt;svg"},
+			[]string{"<svg"},
+		},
+		{
+			"html inside emphasis",
+			`**<i>bold</i>** and *<u>em</u>*`,
+			[]string{"<strong>&lt;i&gt;bold&lt;/i&gt;</strong>", "<em>&lt;u&gt;em&lt;/u&gt;</em>"},
+			[]string{"<i>", "<u>"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rendered := string(renderText(0, 0, test.text, nil, HomePageID, nil))
+			for _, want := range test.contains {
+				if !strings.Contains(rendered, want) {
+					t.Errorf("%q renders to %q, missing %q", test.text, rendered, want)
+				}
+			}
+			for _, unwanted := range test.excludes {
+				if strings.Contains(rendered, unwanted) {
+					t.Errorf("%q renders to %q, containing %q", test.text, rendered, unwanted)
+				}
+			}
+		})
+	}
+}
+
+// The sanitizer still catches markup the renderer should never produce
+func TestSanitizerPolicy(t *testing.T) {
+	tests := []struct {
+		html string
+		want string
+	}{
+		{`<a href="javascript:alert(1)">x</a>`, `x`},
+		{`<a href="data:text/html,x">x</a>`, `x`},
+		{`<a href="/page/1" onclick="x">x</a>`, `<a href="/page/1">x</a>`},
+		{`<a class="evil" href="/page/1">x</a>`, `<a href="/page/1">x</a>`},
+		{`<a class="mention" href="/profile/1">@a</a>`, `<a class="mention" href="/profile/1">@a</a>`},
+		{`<p style="color:red">x</p>`, `<p>x</p>`},
+		{`<script>alert(1)</script>`, ``},
+		{`<iframe src="https://example.com"></iframe>`, ``},
+	}
+	for _, test := range tests {
+		if got := sanitizer.Sanitize(test.html); got != test.want {
+			t.Errorf("Sanitize(%q) = %q, want %q", test.html, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"html"
+	"log/slog"
+	"postpath/database"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Usernames are letters and numbers only, see RegisterHandler
+var mentionPattern = regexp.MustCompile(`@[a-zA-Z0-9]+`)
+
+// Returns the usernames mentioned in a post, without duplicates
+func parseMentions(text string) []string {
+	seen := map[string]bool{}
+	var usernames []string
+	for _, match := range mentionPattern.FindAllStringIndex(text, -1) {
+		if !isMentionStart(text, match[0]) {
+			continue
+		}
+		username := text[match[0]+1 : match[1]]
+		if !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+// An @ only starts a mention at a word boundary, so emails are left alone
+func isMentionStart(text string, index int) bool {
+	if index == 0 {
+		return true
+	}
+	previous, _ := utf8.DecodeLastRuneInString(text[:index])
+	return !unicode.IsLetter(previous) && !unicode.IsDigit(previous) && previous != '_'
+}
+
+// Stores the users a text mentions and notifies the ones it did not mention
+// before, so editing a post never notifies someone twice
+func updateMentions(ctx context.Context, textId int, pageId int, authorId int, text string) error {
+	existing := map[int]bool{}
+	rows, cancel, err := database.QueryWithTimeout(ctx, `SELECT user_id FROM mentions WHERE text_id = ?`, textId)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	for rows.Next() {
+		var userId int
+		if err := rows.Scan(&userId); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[userId] = true
+	}
+	rows.Close()
+
+	current := map[int]bool{}
+	for _, username := range parseMentions(text) {
+		userId := getUserId(ctx, username)
+		if userId == -1 || current[userId] {
+			continue
+		}
+		current[userId] = true
+		if existing[userId] {
+			continue
+		}
+
+		_, cancel, err := database.ExecWithTimeout(ctx, `INSERT INTO mentions (text_id, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING`, textId, userId)
+		if err != nil {
+			return err
+		}
+		cancel()
+		if userId != authorId {
+			if err := notify(ctx, userId, authorId, NotificationMention, pageId, textId); err != nil {
+				return err
+			}
+		}
+	}
+
+	for userId := range existing {
+		if current[userId] {
+			continue
+		}
+		_, cancel, err := database.ExecWithTimeout(ctx, `DELETE FROM mentions WHERE text_id = ? AND user_id = ?`, textId, userId)
+		if err != nil {
+			return err
+		}
+		cancel()
+	}
+
+	return nil
+}
+
+// Returns the users mentioned by each text on a page, keyed by username
+func getPageMentions(ctx context.Context, pageId int) map[int]map[string]int {
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT mentions.text_id, users.username, users.id
+		FROM mentions
+		INNER JOIN users ON users.id = mentions.user_id
+		WHERE mentions.text_id IN (SELECT id FROM pagetext WHERE page_id = ?)
+	`, pageId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query mentions", "page_id", pageId, "err", err)
+		return nil
+	}
+	defer cancel()
+	defer rows.Close()
+
+	return scanMentions(rows)
+}
+
+// Returns the users mentioned by each of the given texts, keyed by username
+func getTextMentions(ctx context.Context, textIds ...int) map[int]map[string]int {
+	if len(textIds) == 0 {
+		return nil
+	}
+	args := make([]any, len(textIds))
+	for i, id := range textIds {
+		args[i] = id
+	}
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT mentions.text_id, users.username, users.id
+		FROM mentions
+		INNER JOIN users ON users.id = mentions.user_id
+		WHERE mentions.text_id IN (?`+strings.Repeat(", ?", len(textIds)-1)+`)
+	`, args...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query mentions", "err", err)
+		return nil
+	}
+	defer cancel()
+	defer rows.Close()
+
+	return scanMentions(rows)
+}
+
+// Fills in the mentions of texts gathered from many pages
+func addMentions(ctx context.Context, texts []*PageText) {
+	textIds := make([]int, len(texts))
+	for i, text := range texts {
+		textIds[i] = text.TextID
+	}
+	mentions := getTextMentions(ctx, textIds...)
+	for _, text := range texts {
+		text.Mentions = mentions[text.TextID]
+	}
+}
+
+func scanMentions(rows *sql.Rows) map[int]map[string]int {
+	mentions := map[int]map[string]int{}
+	for rows.Next() {
+		var textId, userId int
+		var username string
+		if err := rows.Scan(&textId, &username, &userId); err != nil {
+			continue
+		}
+		if mentions[textId] == nil {
+			mentions[textId] = map[string]int{}
+		}
+		mentions[textId][username] = userId
+	}
+	return mentions
+}
+
+// Renders a mention as a link to the profile of the user it was saved as
+// mentioning, or as plain text if it named no one
+func mentionHTML(mention string, mentions map[string]int) string {
+	userId, ok := mentions[mention[1:]]
+	if !ok {
+		return html.EscapeString(mention)
+	}
+	return `<a class="mention" href="/profile/` + strconv.Itoa(userId) + `">` + html.EscapeString(mention) + `</a>`
+}
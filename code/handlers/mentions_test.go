@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A mention links to whoever it named when the post was saved, and a name
+// registered afterwards stays plain text until the post is edited
+func TestMentionsResolvedOnSave(t *testing.T) {
+	openTestDB(t)
+	ctx := context.Background()
+	author := createTestUser(t, "author")
+	alice := createTestUser(t, "alice")
+	pageId := createTestPage(t, "Mentions")
+	textId := createTestText(t, pageId, author, 0)
+
+	text := "hello @alice and @bob"
+	if err := updateMentions(ctx, textId, pageId, author, text); err != nil {
+		t.Fatal(err)
+	}
+	bob := createTestUser(t, "bob")
+
+	rendered := string(renderText(textId, 0, text, nil, pageId, getTextMentions(ctx, textId)[textId]))
+	if want := `<a class="mention" href="/profile/` + strconv.Itoa(alice) + `">@alice</a>`; !strings.Contains(rendered, want) {
+		t.Errorf("rendered %q, missing %q", rendered, want)
+	}
+	if strings.Contains(rendered, "/profile/"+strconv.Itoa(bob)) {
+		t.Errorf("rendered %q links a user registered after the post was saved", rendered)
+	}
+
+	if err := updateMentions(ctx, textId, pageId, author, text); err != nil {
+		t.Fatal(err)
+	}
+	mentions := getPageMentions(ctx, pageId)[textId]
+	if mentions["alice"] != alice || mentions["bob"] != bob {
+		t.Errorf("mentions after editing = %v, want alice %d and bob %d", mentions, alice, bob)
+	}
+}
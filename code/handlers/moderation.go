@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"postpath/database"
+	"strings"
+	"unicode/utf8"
+)
+
+func EditDescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	pageId := getPageId(r)
+	if !canModeratePage(r.Context(), pageId, userId) {
+		htmxError(w, "You are not allowed to edit this description.", http.StatusForbidden)
+		return
+	}
+
+	data := map[string]any{
+		"PageID":      pageId,
+		"Description": getPageDescription(r.Context(), pageId),
+	}
+	render(w, r, "editdescription", data)
+}
+
+func EditDescriptionCancelHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	pageId := getPageId(r)
+	data := map[string]any{
+		"PageID":      pageId,
+		"Description": getPageDescription(r.Context(), pageId),
+		"CanModerate": canModeratePage(r.Context(), pageId, userId),
+	}
+	render(w, r, "pagedescription", data)
+}
+
+func UpdateDescriptionHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	pageId := getPageId(r)
+	if !canModeratePage(r.Context(), pageId, userId) {
+		htmxError(w, "You are not allowed to edit this description.", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		htmxError(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	description := strings.TrimSpace(r.FormValue("description"))
+
+	if utf8.RuneCountInString(description) > settings.MaxPostLength {
+		htmxError(w, fmt.Sprintf("Description exceeds maximum length of %d characters", settings.MaxPostLength), http.StatusBadRequest)
+		return
+	}
+
+	_, cancel, err := database.ExecWithTimeout(r.Context(), `UPDATE pages SET description = ? WHERE id = ?`, description, pageId)
+	if err != nil {
+		htmxError(w, "Failed to update description", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+
+	data := map[string]any{
+		"PageID":      pageId,
+		"Description": description,
+		"CanModerate": true,
+	}
+	render(w, r, "pagedescription", data)
+}
+
+// Toggles whether a text is pinned to the top of its page
+func PinTextHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	pageId := getPageId(r)
+	textId := getTextId(r)
+	if textId == -1 {
+		htmxError(w, "TextID missing", http.StatusNotFound)
+		return
+	}
+
+	if !canModeratePage(r.Context(), pageId, userId) {
+		htmxError(w, "You are not allowed to pin on this page.", http.StatusForbidden)
+		return
+	}
+
+	_, cancel, err := database.ExecWithTimeout(r.Context(), `UPDATE pagetext SET is_pinned = 1 - COALESCE(is_pinned, 0) WHERE id = ? and page_id = ?`, textId, pageId)
+	if err != nil {
+		htmxError(w, "Failed to pin text", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+
+	// Pinning changes the page ordering, so reload it
+	w.Header().Set("HX-Refresh", "true")
+	w.WriteHeader(http.StatusOK)
+}
+
+func MergeHandler(w http.ResponseWriter, r *http.Request) {
+	user, userId := GetUserFromContext(r)
+
+	if !isModerator(r.Context(), userId) {
+		http.Redirect(w, r, "/home", http.StatusSeeOther)
+		return
+	}
+
+	data := map[string]any{
+		"Username": user,
+		"LoggedIn": user != "",
+	}
+
+	if r.Method == http.MethodPost {
+		from := normalizeTitle(r.FormValue("from"))
+		into := normalizeTitle(r.FormValue("into"))
+		data["From"] = from
+		data["Into"] = into
+
+		if from == "" || into == "" {
+			data["Error"] = "Both pages are required."
+			render(w, r, "merge", data)
+			return
+		}
+
+		fromId, err := lookupPageId(r.Context(), from)
+		if err != nil {
+			data["Error"] = "Page \"" + from + "\" does not exist."
+			render(w, r, "merge", data)
+			return
+		}
+		intoId, err := lookupPageId(r.Context(), into)
+		if err != nil {
+			data["Error"] = "Page \"" + into + "\" does not exist."
+			render(w, r, "merge", data)
+			return
+		}
+
+		if fromId == intoId {
+			data["Error"] = "Those pages are already the same page."
+			render(w, r, "merge", data)
+			return
+		}
+		if fromId == HomePageID || fromId == ProfilePageID || intoId == ProfilePageID {
+			data["Error"] = "Home and Profile pages cannot be merged."
+			render(w, r, "merge", data)
+			return
+		}
+
+		if err := mergePages(r.Context(), fromId, intoId); err != nil {
+			data["Error"] = "Failed to merge pages."
+			render(w, r, "merge", data)
+			return
+		}
+
+		data["From"] = ""
+		data["Into"] = ""
+		data["Flash"] = "Merged \"" + from + "\" into \"" + into + "\"."
+	}
+
+	render(w, r, "merge", data)
+}
+
+// Helper Functions
+
+// Merges one page into another, dropping the merged page's cached title
+func mergePages(ctx context.Context, fromId int, intoId int) error {
+	if err := database.MergePages(ctx, fromId, intoId); err != nil {
+		return err
+	}
+	titleCache.remove(fromId)
+	return nil
+}
+
+func isModerator(ctx context.Context, userId int) bool {
+	var moderator int
+
+	row, cancel := database.QueryRowWithTimeout(ctx, "SELECT COALESCE(is_moderator, 0) FROM users WHERE id = ?", userId)
+	defer cancel()
+
+	if err := row.Scan(&moderator); err != nil {
+		return false
+	}
+
+	return moderator == 1
+}
+
+// Page owners and moderators may edit descriptions and pin texts
+func canModeratePage(ctx context.Context, pageId int, userId int) bool {
+	if pageId == ProfilePageID || userId <= 0 {
+		return false
+	}
+
+	var ownerId sql.NullInt64
+	row, cancel := database.QueryRowWithTimeout(ctx, "SELECT owner_id FROM pages WHERE id = ?", pageId)
+	defer cancel()
+
+	if err := row.Scan(&ownerId); err != nil {
+		return false
+	}
+
+	if ownerId.Valid && int(ownerId.Int64) == userId {
+		return true
+	}
+
+	return isModerator(ctx, userId)
+}
+
+func getPageDescription(ctx context.Context, pageId int) string {
+	var description sql.NullString
+
+	row, cancel := database.QueryRowWithTimeout(ctx, "SELECT description FROM pages WHERE id = ?", pageId)
+	defer cancel()
+
+	if err := row.Scan(&description); err != nil {
+		return ""
+	}
+
+	return description.String
+}
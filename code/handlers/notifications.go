@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"postpath/database"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of notification
+const (
+	NotificationMention     = "mention"
+	NotificationPagePost    = "page_post"
+	NotificationProfilePost = "profile_post"
+	NotificationPageLink    = "page_link"
+	NotificationReply       = "reply"
+)
+
+// Number of notifications shown on the notifications page
+const notificationLimit = 50
+
+type Notification struct {
+	ID           int
+	Kind         string
+	Actor        string
+	ActorID      int
+	PageID       int
+	PageTitle    string
+	PagePath     string
+	TextID       int
+	Text         string
+	CreatedAtStr string
+	Read         bool
+}
+
+// Describes the notification for the notifications page
+func (n Notification) Message() string {
+	switch n.Kind {
+	case NotificationMention:
+		return "mentioned you"
+	case NotificationPagePost:
+		return "posted on your page"
+	case NotificationProfilePost:
+		return "posted on your profile"
+	case NotificationPageLink:
+		return "linked to your page"
+	case NotificationReply:
+		return "replied to your post"
+	}
+	return "did something"
+}
+
+func NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	user, userId := GetUserFromContext(r)
+
+	data := map[string]any{
+		"Username":      user,
+		"LoggedIn":      user != "",
+		"Notifications": getNotifications(r.Context(), userId),
+	}
+	render(w, r, "notifications", data)
+}
+
+func NotificationBellHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	data := map[string]any{
+		"UnreadCount": unreadNotificationCount(r.Context(), userId),
+	}
+	render(w, r, "notificationbell", data)
+}
+
+func MarkNotificationReadHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	id, err := strconv.Atoi(mux.Vars(r)["notificationId"])
+	if err != nil {
+		htmxError(w, "NotificationID missing", http.StatusNotFound)
+		return
+	}
+
+	_, cancel, err := database.ExecWithTimeout(r.Context(), `UPDATE notifications SET read_at = ? WHERE id = ? AND user_id = ? AND read_at IS NULL`, time.Now(), id, userId)
+	if err != nil {
+		htmxError(w, "Failed to mark notification as read", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+
+	n, ok := getNotification(r.Context(), userId, id)
+	if !ok {
+		htmxError(w, "Notification not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("HX-Trigger", "notificationsRead")
+	render(w, r, "notification", map[string]any{"Notification": n})
+}
+
+func MarkAllNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	user, userId := GetUserFromContext(r)
+
+	_, cancel, err := database.ExecWithTimeout(r.Context(), `UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL`, time.Now(), userId)
+	if err != nil {
+		htmxError(w, "Failed to mark notifications as read", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+
+	data := map[string]any{
+		"Username":      user,
+		"LoggedIn":      user != "",
+		"Notifications": getNotifications(r.Context(), userId),
+	}
+	w.Header().Set("HX-Trigger", "notificationsRead")
+	render(w, r, "notifications", data)
+}
+
+// Helper Functions
+
+// Records a notification for a user about something another user did
+func notify(ctx context.Context, userId int, actorId int, kind string, pageId int, textId int) error {
+	if userId <= 0 || userId == actorId {
+		return nil
+	}
+	_, cancel, err := database.ExecWithTimeout(ctx,
+		`INSERT INTO notifications (user_id, actor_id, kind, page_id, text_id) VALUES (?, ?, ?, ?, ?)`,
+		userId, actorId, kind, pageId, textId,
+	)
+	if err != nil {
+		return err
+	}
+	cancel()
+	return nil
+}
+
+// Notifies the owner of a page, if it has one
+func notifyPageOwner(ctx context.Context, ownedPageId int, actorId int, kind string, pageId int, textId int) error {
+	var ownerId sql.NullInt64
+	row, cancel := database.QueryRowWithTimeout(ctx, `SELECT owner_id FROM pages WHERE id = ?`, ownedPageId)
+	defer cancel()
+
+	if err := row.Scan(&ownerId); err != nil || !ownerId.Valid {
+		return err
+	}
+	return notify(ctx, int(ownerId.Int64), actorId, kind, pageId, textId)
+}
+
+// Sends the notifications for a new text: the page owner hears about the
+// post and the owners of any linked pages hear about the link
+func notifyNewText(ctx context.Context, pageId int, textId int, actorId int, linkIds []int) {
+	if err := notifyPageOwner(ctx, pageId, actorId, NotificationPagePost, pageId, textId); err != nil {
+		slog.ErrorContext(ctx, "Failed to notify page owner", "page_id", pageId, "err", err)
+	}
+	notifyLinkedPages(ctx, pageId, textId, actorId, linkIds)
+}
+
+// Notifies the owners of the pages a text links to
+func notifyLinkedPages(ctx context.Context, pageId int, textId int, actorId int, linkIds []int) {
+	notified := map[int]bool{}
+	for _, linkId := range linkIds {
+		if notified[linkId] || linkId == pageId {
+			continue
+		}
+		notified[linkId] = true
+		if err := notifyPageOwner(ctx, linkId, actorId, NotificationPageLink, pageId, textId); err != nil {
+			slog.ErrorContext(ctx, "Failed to notify page owner", "page_id", linkId, "err", err)
+		}
+	}
+}
+
+// Sends the notifications for a reply: the author of the post replied to
+// hears about it, and so does the owner of a profile the thread is on
+func notifyReply(ctx context.Context, pageId int, textId int, actorId int, parentAuthorId int, linkIds []int) {
+	if err := notify(ctx, parentAuthorId, actorId, NotificationReply, pageId, textId); err != nil {
+		slog.ErrorContext(ctx, "Failed to notify reply parent author", "text_id", textId, "err", err)
+	}
+
+	if pageId == ProfilePageID {
+		ownerId := getThreadProfile(ctx, textId)
+		if ownerId != parentAuthorId {
+			if err := notify(ctx, ownerId, actorId, NotificationProfilePost, pageId, textId); err != nil {
+				slog.ErrorContext(ctx, "Failed to notify profile owner", "user_id", ownerId, "err", err)
+			}
+		}
+	}
+
+	notifyLinkedPages(ctx, pageId, textId, actorId, linkIds)
+}
+
+func unreadNotificationCount(ctx context.Context, userId int) int {
+	var count int
+
+	row, cancel := database.QueryRowWithTimeout(ctx, `SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL`, userId)
+	defer cancel()
+
+	if err := row.Scan(&count); err != nil {
+		return 0
+	}
+	return count
+}
+
+// Columns and joins a Notification is scanned from
+const notificationQuery = `
+	SELECT
+		notifications.id,
+		notifications.kind,
+		users.username,
+		notifications.actor_id,
+		COALESCE(notifications.page_id, 0),
+		COALESCE(pages.title, ''),
+		COALESCE(pagetext.path, ''),
+		COALESCE(notifications.text_id, 0),
+		COALESCE(pagetext.text, ''),
+		notifications.created_at,
+		notifications.read_at IS NOT NULL
+	FROM notifications
+	INNER JOIN users ON notifications.actor_id = users.id
+	LEFT JOIN pages ON notifications.page_id = pages.id
+	LEFT JOIN pagetext ON notifications.text_id = pagetext.id
+`
+
+func getNotifications(ctx context.Context, userId int) []Notification {
+	rows, cancel, err := database.QueryWithTimeout(ctx, notificationQuery+`
+		WHERE notifications.user_id = ?
+		ORDER BY notifications.created_at DESC, notifications.id DESC
+		LIMIT ?
+	`, userId, notificationLimit)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query notifications", "user_id", userId, "err", err)
+		return nil
+	}
+	defer cancel()
+	defer rows.Close()
+
+	var notifications []Notification
+	for rows.Next() {
+		if n, err := scanNotification(rows); err == nil {
+			notifications = append(notifications, n)
+		}
+	}
+	return notifications
+}
+
+// Returns one of a user's notifications
+func getNotification(ctx context.Context, userId int, id int) (Notification, bool) {
+	rows, cancel, err := database.QueryWithTimeout(ctx, notificationQuery+`
+		WHERE notifications.id = ? AND notifications.user_id = ?
+	`, id, userId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query notification", "notification_id", id, "err", err)
+		return Notification{}, false
+	}
+	defer cancel()
+	defer rows.Close()
+
+	if !rows.Next() {
+		return Notification{}, false
+	}
+	n, err := scanNotification(rows)
+	return n, err == nil
+}
+
+func scanNotification(rows *sql.Rows) (Notification, error) {
+	var n Notification
+	var createdAt time.Time
+	var sourcePath string
+	if err := rows.Scan(
+		&n.ID, &n.Kind, &n.Actor, &n.ActorID, &n.PageID, &n.PageTitle,
+		&sourcePath, &n.TextID, &n.Text, &createdAt, &n.Read,
+	); err != nil {
+		return n, err
+	}
+	n.PagePath = pagePath(sourcePath, n.PageID)
+	if n.PageID == ProfilePageID {
+		n.PagePath = ""
+	}
+	n.CreatedAtStr = createdAt.Format("2006-01-02 15:04")
+	return n, nil
+}
+
+// Builds the full path of a page from the source path stored with a text
+func pagePath(sourcePath string, pageId int) string {
+	id := strconv.Itoa(pageId)
+	if sourcePath == "" {
+		return id
+	}
+	segments := strings.Split(sourcePath, "/")
+	if segments[len(segments)-1] == id {
+		return sourcePath
+	}
+	return sourcePath + "/" + id
+}
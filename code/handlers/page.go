@@ -3,9 +3,13 @@ package handlers
 import (
 	"context"
 	"database/sql"
-	"log"
+	"fmt"
+	"log/slog"
+	"maps"
 	"net/http"
 	"postpath/database"
+	"postpath/logging"
+	"postpath/metrics"
 	"strconv"
 	"strings"
 	"time"
@@ -14,10 +18,6 @@ import (
 	"github.com/gorilla/mux"
 )
 
-const (
-	MaxInputLength = 500
-)
-
 var HomePageID, ProfilePageID int
 
 type PageTitle struct {
@@ -38,13 +38,25 @@ type PageText struct {
 	SourcePath   string
 	Source       int
 	SourceTitle  string
+	Pinned       int
+	CanPin       bool
+	Revision     int
+	OOB          bool
+	CreatedAt    time.Time
+	Reactions    []Reaction
+	Upvotes      int
+	ParentID     int
+	Replies      []PageText
+	ReplyCount   int
+	Attachments  []Attachment
+	Preview      *LinkPreview
+	Mentions     map[string]int
 }
 
 func HandlerInit() {
-	rows, cancel, err := database.QueryWithTimeout(`SELECT id, title FROM pages WHERE title IN (?, ?)`, "Home", "Profile")
+	rows, cancel, err := database.QueryWithTimeout(context.Background(), `SELECT id, title FROM pages WHERE title IN (?, ?)`, "Home", "Profile")
 	if err != nil {
-		log.Printf("Query error: %v", err)
-		log.Fatalf("failed to query page IDs: %v", err)
+		logging.Fatal("Failed to query page IDs", "err", err)
 	}
 	defer cancel()
 	defer rows.Close()
@@ -56,8 +68,7 @@ func HandlerInit() {
 		var id int
 		var title string
 		if err := rows.Scan(&id, &title); err != nil {
-			log.Printf("Scan error: %v", err)
-			log.Fatalf("failed to scan row: %v", err)
+			logging.Fatal("Failed to scan page ID", "err", err)
 		}
 		switch title {
 		case "Home":
@@ -71,16 +82,15 @@ func HandlerInit() {
 
 	// Check for errors from iterating over rows
 	if err = rows.Err(); err != nil {
-		log.Printf("Row iteration error: %v", err)
-		log.Fatalf("error during row iteration: %v", err)
+		logging.Fatal("Failed to read page IDs", "err", err)
 	}
 
 	// Verify we found both pages
 	if !foundHome || !foundProfile {
-		log.Fatalf("missing required pages: home=%d, profile=%d", HomePageID, ProfilePageID)
+		logging.Fatal("Missing required pages", "home_page_id", HomePageID, "profile_page_id", ProfilePageID)
 	}
 
-	log.Printf("HandlerInit complete: HomePageID=%d, ProfilePageID=%d", HomePageID, ProfilePageID)
+	slog.Info("Handlers initialized", "home_page_id", HomePageID, "profile_page_id", ProfilePageID)
 }
 
 func PageHandler(w http.ResponseWriter, r *http.Request) {
@@ -106,15 +116,44 @@ func ProfilePageHandler(w http.ResponseWriter, r *http.Request) {
 		profileId = userId
 	} else {
 		profileId = path[len(path)-1]
-		user = getUsername(profileId)
+		user = getUsername(r.Context(), profileId)
 	}
-	renderPage(w, r, []int{ProfilePageID}, user, profileId, userId == profileId, true)
+	// Others can post on a profile only once its owner has opened it
+	editable := userId > 0 && (userId == profileId || isProfileOpen(r.Context(), profileId))
+	renderPage(w, r, []int{ProfilePageID}, user, profileId, editable, true)
+}
+
+// Lets other users post on the signed-in user's profile
+func OpenProfileHandler(w http.ResponseWriter, r *http.Request) {
+	setProfileOpen(w, r, true)
+}
+
+// Stops other users from posting on the signed-in user's profile
+func CloseProfileHandler(w http.ResponseWriter, r *http.Request) {
+	setProfileOpen(w, r, false)
+}
+
+func setProfileOpen(w http.ResponseWriter, r *http.Request, open bool) {
+	_, userId := GetUserFromContext(r)
+
+	value := 0
+	if open {
+		value = 1
+	}
+	_, cancel, err := database.ExecWithTimeout(r.Context(), `UPDATE users SET open_profile = ? WHERE id = ?`, value, userId)
+	if err != nil {
+		htmxError(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+
+	render(w, r, "openprofilebutton", map[string]any{"ProfileOpen": open})
 }
 
 func AddTextHandler(w http.ResponseWriter, r *http.Request) {
 	user, userId := GetUserFromContext(r)
 
-	if err := r.ParseForm(); err != nil {
+	if err := parsePostForm(w, r); err != nil {
 		htmxError(w, "Unable to parse form", http.StatusBadRequest)
 		return
 	}
@@ -123,74 +162,107 @@ func AddTextHandler(w http.ResponseWriter, r *http.Request) {
 	text = strings.TrimSpace(text)
 
 	// Add length validation
-	if utf8.RuneCountInString(text) > MaxInputLength {
-		htmxError(w, "Text exceeds maximum length of 500 characters", http.StatusBadRequest)
+	if utf8.RuneCountInString(text) > settings.MaxPostLength {
+		htmxError(w, fmt.Sprintf("Text exceeds maximum length of %d characters", settings.MaxPostLength), http.StatusBadRequest)
+		return
+	}
+
+	upload, err := readImageUpload(r)
+	if err != nil {
+		htmxError(w, "Image upload failed: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	path := getPath(r)
+	if path == nil {
+		htmxError(w, "Invalid page path", http.StatusBadRequest)
+		return
+	}
 	source := path[len(path)-1]
 	pageId := path[len(path)-1]
 	if len(path) > 1 {
 		source = path[len(path)-2]
 	}
 	sourcePath := getSourcePath(r)
+	profileId, ok := postProfile(r, pageId, userId)
+	if !ok {
+		htmxError(w, "You cannot post on this profile.", http.StatusForbidden)
+		return
+	}
 
-	if text == "" {
+	if text == "" && upload == nil {
 		htmxError(w, "Text cannot be empty", http.StatusBadRequest)
 		return
 	}
 
-	lText := strings.ToLower(text)
-	log.Printf("Adding text to page ID: %v with sourcePath %s and source %v", pageId, sourcePath, source)
+	slog.DebugContext(r.Context(), "Adding text", "page_id", pageId, "source", source)
 
-	if len(strings.Fields(text)) == 1 && len(path) > 0 && path[0] != ProfilePageID {
-		// One word: Handle as a link
-		text = lText
-		var linkID int
-		row, cancel := database.QueryRowWithTimeout(`SELECT id FROM pages WHERE title = ?`, lText)
-		defer cancel()
-		err := row.Scan(&linkID)
-		if err == sql.ErrNoRows {
-			// Link does not exist yet, insert it
-			result, err := database.DB().Exec(`INSERT INTO pages (title) VALUES (?)`, lText)
-			if err != nil {
-				htmxError(w, "Failed to insert into pages", http.StatusInternalServerError)
-				return
-			}
-			lastInsertId, err := result.LastInsertId()
-			if err != nil {
-				htmxError(w, "Failed to get inserted link id", http.StatusInternalServerError)
-				return
-			}
-			linkID = int(lastInsertId)
-		} else if err != nil {
-			htmxError(w, "Failed to query pages", http.StatusInternalServerError)
+	title, isLink := parseLink(text)
+	if isLink && upload == nil && path[0] != ProfilePageID {
+		// Link post: a single word, [[a title]] or → a title
+		text = title
+		linkID, err := ensurePage(r.Context(), title, userId)
+		if err != nil {
+			htmxError(w, "Failed to find or create linked page", http.StatusInternalServerError)
 			return
 		}
-		_, err = database.DB().Exec(`INSERT INTO pagetext (page_id, user_id, text, link_id, created_at, path, source) VALUES (?, ?, ?, ?, ?, ?, ?)`, pageId, userId, text, linkID, time.Now(), sourcePath, source)
-		if err != nil {
+		var textId int64
+		row, cancel := database.QueryRowWithTimeout(r.Context(), `INSERT INTO pagetext (page_id, user_id, text, link_id, created_at, path, source) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`, pageId, userId, text, linkID, time.Now(), sourcePath, source)
+		defer cancel()
+		if err := row.Scan(&textId); err != nil {
 			htmxError(w, "Failed to insert text into pagetext", http.StatusInternalServerError)
 			return
 		}
+		metrics.PostCreated("link")
+		notifyNewText(r.Context(), pageId, int(textId), userId, []int{linkID})
 
-		data := map[string]any{"PageID": pageId, "Text": text, "LinkID": linkID, "Path": path, "User": user, "CreatedAtStr": time.Now().Format("2006-01-02 15:04")}
+		data := map[string]any{"PageID": pageId, "Text": text, "TextID": int(textId), "LinkID": linkID, "Path": path, "UserID": userId, "User": user, "CreatedAtStr": time.Now().Format("2006-01-02 15:04"), "Reactions": emptyReactions()}
 		render(w, r, "addlink", data)
+		publishFragment(r.Context(), pageId, userId, EventAppend, "addlink", data)
 	} else {
-		// More than one word: Normal text
-
-		result, err := database.DB().Exec(`INSERT INTO pagetext (page_id, user_id, text, link_id, created_at, path, source) VALUES (?, ?, ?, NULL, ?, ?, ?)`, pageId, userId, text, time.Now(), sourcePath, source)
+		// Normal text, which may reference pages inline with [[a title]]
+		linkIDs, err := ensureInlinePages(r.Context(), text, userId)
 		if err != nil {
-			http.Error(w, "Failed to insert text", http.StatusInternalServerError)
+			htmxError(w, "Failed to create linked pages", http.StatusInternalServerError)
 			return
 		}
-		textId, err := result.LastInsertId()
-		if err != nil {
-			http.Error(w, "Failed to get inserted link id", http.StatusInternalServerError)
+
+		var textId int64
+		row, cancel := database.QueryRowWithTimeout(r.Context(), `INSERT INTO pagetext (page_id, user_id, text, link_id, created_at, path, source, profile_id) VALUES (?, ?, ?, NULL, ?, ?, ?, ?) RETURNING id`, pageId, userId, text, time.Now(), sourcePath, source, profileId)
+		defer cancel()
+		if err := row.Scan(&textId); err != nil {
+			http.Error(w, "Failed to insert text", http.StatusInternalServerError)
 			return
 		}
-		data := map[string]any{"PageID": pageId, "Text": text, "TextID": textId, "User": user, "CreatedAtStr": time.Now().Format("2006-01-02 15:04"), "Edited": 0}
-		render(w, r, "addtext", data)
+		var attachments []Attachment
+		if upload != nil {
+			attachment, err := saveAttachment(r.Context(), int(textId), userId, upload)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to save attachment", "text_id", textId, "err", err)
+				if _, cancel, err := database.ExecWithTimeout(r.Context(), `DELETE FROM pagetext WHERE id = ?`, textId); err == nil {
+					cancel()
+				}
+				htmxError(w, "Failed to save image", http.StatusInternalServerError)
+				return
+			}
+			attachments = append(attachments, attachment)
+		}
+		if err := updateMentions(r.Context(), int(textId), pageId, userId, text); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to save mentions", "text_id", textId, "err", err)
+		}
+		metrics.PostCreated("text")
+		notifyNewText(r.Context(), pageId, int(textId), userId, linkIDs)
+		if profileId.Valid {
+			if err := notify(r.Context(), int(profileId.Int64), userId, NotificationProfilePost, pageId, int(textId)); err != nil {
+				slog.ErrorContext(r.Context(), "Failed to notify profile owner", "user_id", profileId.Int64, "err", err)
+			}
+		}
+		queueLinkPreview(r.Context(), text)
+		data := map[string]any{"PageID": pageId, "Text": text, "TextID": int(textId), "Path": path, "UserID": userId, "User": user, "CreatedAtStr": time.Now().Format("2006-01-02 15:04"), "Edited": 0, "Revision": 0, "Reactions": emptyReactions(), "Attachments": attachments, "Preview": getLinkPreview(r.Context(), text), "Mentions": getTextMentions(r.Context(), int(textId))[int(textId)]}
+		render(w, r, "thread", data)
+		if pageId != ProfilePageID {
+			publishFragment(r.Context(), pageId, userId, EventAppend, "thread", data)
+		}
 	}
 }
 
@@ -205,7 +277,7 @@ func EditTextHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var text string
-	row, cancel := database.QueryRowWithTimeout(`SELECT text FROM pagetext WHERE id = ? and user_id = ?`, textId, userId)
+	row, cancel := database.QueryRowWithTimeout(r.Context(), `SELECT text FROM pagetext WHERE id = ? and user_id = ?`, textId, userId)
 	defer cancel()
 	err := row.Scan(&text)
 	if err == sql.ErrNoRows {
@@ -225,6 +297,8 @@ func EditTextHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func EditTextCancelHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
 	pageId := getPageId(r)
 	textId := getTextId(r)
 	if textId == -1 {
@@ -232,7 +306,7 @@ func EditTextCancelHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, cancel, err := database.QueryWithTimeout(`
+	rows, cancel, err := database.QueryWithTimeout(r.Context(), `
 		SELECT 
 			pagetext.page_id, 
 			pagetext.id, 
@@ -242,7 +316,8 @@ func EditTextCancelHandler(w http.ResponseWriter, r *http.Request) {
 			pagetext.is_edited,
 			pagetext.path,
 			pagetext.source,
-			pages.title AS source_title
+			pages.title AS source_title,
+			pagetext.revision
 		FROM pagetext
 		INNER JOIN users ON pagetext.user_id = users.id
 		LEFT JOIN pages ON pagetext.source = pages.id
@@ -260,11 +335,10 @@ func EditTextCancelHandler(w http.ResponseWriter, r *http.Request) {
 
 			if err := rows.Scan(
 				&pt.PageID, &pt.TextID, &pt.Text,
-				&pt.User, &createdAt, &pt.Edited, &pt.SourcePath, &pt.Source, &pt.SourceTitle,
+				&pt.User, &createdAt, &pt.Edited, &pt.SourcePath, &pt.Source, &pt.SourceTitle, &pt.Revision,
 			); err == nil {
 				pt.CreatedAtStr = createdAt.Format("2006-01-02 15:04")
 				text = pt
-				log.Println(text)
 			}
 		}
 	}
@@ -279,12 +353,17 @@ func EditTextCancelHandler(w http.ResponseWriter, r *http.Request) {
 		"Source":       text.Source,
 		"SourcePath":   text.SourcePath,
 		"SourceTitle":  text.SourceTitle,
+		"Revision":     text.Revision,
+		"Reactions":    getTextReactions(r.Context(), textId, userId),
+		"Attachments":  getTextAttachments(r.Context(), textId),
+		"Preview":      getLinkPreview(r.Context(), text.Text),
+		"Mentions":     getTextMentions(r.Context(), textId)[textId],
 	}
 	render(w, r, "addtext", data)
 }
 
 func UpdateTextHandler(w http.ResponseWriter, r *http.Request) {
-	user, _ := GetUserFromContext(r)
+	user, userId := GetUserFromContext(r)
 
 	pageId := getPageId(r)
 	textId := getTextId(r)
@@ -301,33 +380,56 @@ func UpdateTextHandler(w http.ResponseWriter, r *http.Request) {
 	text := strings.TrimSpace(r.FormValue("text"))
 
 	// Add length validation
-	if utf8.RuneCountInString(text) > MaxInputLength {
-		htmxError(w, "Text exceeds maximum length of 500 characters", http.StatusBadRequest)
+	if utf8.RuneCountInString(text) > settings.MaxPostLength {
+		htmxError(w, fmt.Sprintf("Text exceeds maximum length of %d characters", settings.MaxPostLength), http.StatusBadRequest)
 		return
 	}
 
 	if text == "" {
 		// If empty, delete the text
-		_, err := database.DB().Exec(`DELETE FROM pagetext WHERE id = ? and page_id = ?`, textId, pageId)
-		if err != nil {
-			htmxError(w, "Failed to delete text", http.StatusInternalServerError)
+		if !deleteText(w, r, pageId, textId, userId) {
 			return
 		}
+		publishRemoval(pageId, userId, textId)
+		w.Header().Set("HX-Retarget", "#thread-"+strconv.Itoa(textId))
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	_, err := database.DB().Exec(`UPDATE pagetext SET text = ?, is_edited = 1 WHERE id = ? and page_id = ?`, text, textId, pageId)
-	if err != nil {
+	if _, err := ensureInlinePages(r.Context(), text, userId); err != nil {
+		htmxError(w, "Failed to create linked pages", http.StatusInternalServerError)
+		return
+	}
+
+	var revision int
+	row, cancel := database.QueryRowWithTimeout(r.Context(), `UPDATE pagetext SET text = ?, is_edited = 1, revision = revision + 1 WHERE id = ? and page_id = ? and user_id = ? RETURNING revision`, text, textId, pageId, userId)
+	defer cancel()
+	err := row.Scan(&revision)
+	if err == sql.ErrNoRows {
+		htmxError(w, "You are not allowed to edit this text.", http.StatusNotFound)
+		return
+	} else if err != nil {
 		htmxError(w, "Failed to update text", http.StatusInternalServerError)
 		return
 	}
 
-	data := map[string]any{"PageID": pageId, "Text": text, "TextID": textId, "User": user, "CreatedAtStr": "Just Now", "Edited": 1}
+	if err := updateMentions(r.Context(), textId, pageId, userId, text); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save mentions", "text_id", textId, "err", err)
+	}
+	queueLinkPreview(r.Context(), text)
+
+	data := map[string]any{"PageID": pageId, "Text": text, "TextID": textId, "UserID": userId, "User": user, "CreatedAtStr": "Just Now", "Edited": 1, "Revision": revision, "Reactions": getTextReactions(r.Context(), textId, userId), "Attachments": getTextAttachments(r.Context(), textId), "Preview": getLinkPreview(r.Context(), text), "Mentions": getTextMentions(r.Context(), textId)[textId]}
 	render(w, r, "addtext", data)
+
+	update := maps.Clone(data)
+	update["OOB"] = true
+	update["Reactions"] = getTextReactions(r.Context(), textId, 0)
+	publishFragment(r.Context(), pageId, userId, EventUpdate, "addtext", update)
 }
 
 func DeleteTextHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
 	pageId := getPageId(r)
 	textId := getTextId(r)
 	if textId == -1 {
@@ -335,40 +437,73 @@ func DeleteTextHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := database.DB().Exec(`DELETE FROM pagetext WHERE id = ? and page_id = ?`, textId, pageId)
-	if err != nil {
-		htmxError(w, "Failed to delete text", http.StatusInternalServerError)
+	if !deleteText(w, r, pageId, textId, userId) {
 		return
 	}
 
+	publishRemoval(pageId, userId, textId)
+	w.Header().Set("HX-Retarget", "#thread-"+strconv.Itoa(textId))
 	w.WriteHeader(http.StatusOK)
 }
 
 // Helper Functions
+
+// Deletes the user's own text from a page along with its stored attachment
+// files. Files are only removed once the row is known to be gone, so a text
+// id from another page or another author cannot delete those uploads.
+// Writes the error response and returns false on failure.
+func deleteText(w http.ResponseWriter, r *http.Request, pageId int, textId int, userId int) bool {
+	keys := attachmentKeys(r.Context(), pageId, textId, userId)
+	result, cancel, err := database.ExecWithTimeout(r.Context(), `DELETE FROM pagetext WHERE id = ? and page_id = ? and user_id = ?`, textId, pageId, userId)
+	if err != nil {
+		htmxError(w, "Failed to delete text", http.StatusInternalServerError)
+		return false
+	}
+	defer cancel()
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		htmxError(w, "Failed to delete text", http.StatusInternalServerError)
+		return false
+	}
+	if deleted == 0 {
+		htmxError(w, "You are not allowed to delete this text.", http.StatusNotFound)
+		return false
+	}
+	deleteUploads(r.Context(), keys)
+	return true
+}
+
 func renderPage(w http.ResponseWriter, r *http.Request, path []int, user string, userId int, editable bool, filtered bool) {
 	pageId := path[len(path)-1]
-	var pageTitles []PageTitle
 
-	for _, id := range path {
-		var title string
-		row, cancel := database.QueryRowWithTimeout(`SELECT title FROM pages WHERE id = ?`, id)
-		defer cancel()
+	pageTitles, ok, err := getPathTitles(r.Context(), path)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to query page titles", "path", joinPath(path), "err", err)
+	}
+	if !ok {
+		http.Redirect(w, r, "/home", http.StatusSeeOther)
+		return
+	}
 
-		err := row.Scan(&title)
-		if err != nil {
-			http.Redirect(w, r, "/home", http.StatusSeeOther)
-			return
+	// Descriptions and pinning only apply to shared pages, not filtered profiles
+	var description string
+	canModerate := false
+	watch := map[string]any{}
+	if !filtered {
+		_, viewerId := GetUserFromContext(r)
+		description = getPageDescription(r.Context(), pageId)
+		canModerate = canModeratePage(r.Context(), pageId, viewerId)
+		if viewerId > 0 {
+			watch = watchData(r.Context(), viewerId, path)
+			recordPageVisit(r.Context(), viewerId, pageId)
 		}
-
-		pageTitles = append(pageTitles, PageTitle{ID: id, Title: title})
 	}
-	log.Println(pageTitles)
-	log.Println("Loading text for " + pageTitles[len(pageTitles)-1].Title)
+
 	var rows *sql.Rows
 	var cancel context.CancelFunc
-	var err error
 	if !filtered {
-		rows, cancel, err = database.QueryWithTimeout(`
+		rows, cancel, err = database.QueryWithTimeout(r.Context(), `
 		SELECT 
 			pagetext.page_id, 
 			pagetext.id, 
@@ -380,15 +515,17 @@ func renderPage(w http.ResponseWriter, r *http.Request, path []int, user string,
 			pagetext.is_edited,
 			pagetext.path,
 			pagetext.source,
-			pages.title AS source_title
+			pages.title AS source_title,
+			pagetext.is_pinned,
+			pagetext.revision
 		FROM pagetext
 		INNER JOIN users ON pagetext.user_id = users.id
 		LEFT JOIN pages ON pagetext.source = pages.id
-		WHERE pagetext.page_id = ?
-		ORDER BY pagetext.created_at ASC
+		WHERE pagetext.page_id = ? AND pagetext.parent_id IS NULL
+		ORDER BY pagetext.is_pinned DESC, pagetext.created_at ASC
 		`, pageId)
 	} else {
-		rows, cancel, err = database.QueryWithTimeout(`
+		rows, cancel, err = database.QueryWithTimeout(r.Context(), `
 		SELECT 
 			pagetext.page_id, 
 			pagetext.id, 
@@ -400,12 +537,14 @@ func renderPage(w http.ResponseWriter, r *http.Request, path []int, user string,
 			pagetext.is_edited,
 			pagetext.path,
 			pagetext.source,
-			pages.title AS source_title
+			pages.title AS source_title,
+			pagetext.is_pinned,
+			pagetext.revision
 		FROM pagetext
 		INNER JOIN users ON pagetext.user_id = users.id
 		LEFT JOIN pages ON pagetext.source = pages.id
-		WHERE pagetext.page_id = ? and pagetext.user_id = ?
-		ORDER BY pagetext.created_at ASC
+		WHERE pagetext.page_id = ? AND COALESCE(pagetext.profile_id, pagetext.user_id) = ? AND pagetext.parent_id IS NULL
+		ORDER BY pagetext.is_pinned DESC, pagetext.created_at ASC
 		`, pageId, userId)
 	}
 	var texts []PageText
@@ -419,25 +558,64 @@ func renderPage(w http.ResponseWriter, r *http.Request, path []int, user string,
 
 			if err := rows.Scan(
 				&pt.PageID, &pt.TextID, &pt.Text, &linkId, &pt.UserID,
-				&pt.User, &createdAt, &pt.Edited, &pt.SourcePath, &pt.Source, &pt.SourceTitle,
+				&pt.User, &createdAt, &pt.Edited, &pt.SourcePath, &pt.Source, &pt.SourceTitle, &pt.Pinned, &pt.Revision,
 			); err == nil {
 				if linkId.Valid {
 					pt.LinkID = int(linkId.Int64)
 				}
 				pt.Path = path
+				pt.CanPin = canModerate
+				pt.CreatedAt = createdAt
 				pt.CreatedAtStr = createdAt.Format("2006-01-02 15:04")
 				texts = append(texts, pt)
 			}
 		}
 	}
 
+	_, viewerId := GetUserFromContext(r)
+	attachReplies(texts, getPageReplies(r.Context(), pageId, path))
+	addTextDetails(texts, getPageReactions(r.Context(), pageId, viewerId), getPageAttachments(r.Context(), pageId), getPageMentions(r.Context(), pageId))
+	addLinkPreviews(r.Context(), texts)
+	order := getSort(r)
+	sortTexts(texts, order)
+
+	// Profiles of other users can be followed, and owners choose whether
+	// others may post on their own
+	canFollow := false
+	following := false
+	ownProfile := false
+	profileOpen := false
+	if filtered {
+		_, viewerId := GetUserFromContext(r)
+		canFollow = viewerId > 0 && viewerId != userId
+		following = canFollow && isFollowing(r.Context(), viewerId, userId)
+		ownProfile = viewerId > 0 && viewerId == userId
+		profileOpen = ownProfile && isProfileOpen(r.Context(), userId)
+	}
+
 	data := map[string]any{
-		"Username":   user,
-		"LoggedIn":   user != "",
-		"PageID":     pageId,
-		"PageTitles": pageTitles,
-		"Texts":      texts,
-		"Editable":   editable,
+		"Username":    user,
+		"LoggedIn":    user != "",
+		"PageID":      pageId,
+		"PageTitles":  pageTitles,
+		"Texts":       texts,
+		"Editable":    editable,
+		"Live":        !filtered,
+		"ProfileID":   userId,
+		"OnProfile":   filtered,
+		"CanFollow":   canFollow,
+		"Following":   following,
+		"OwnProfile":  ownProfile,
+		"ProfileOpen": profileOpen,
+		"Description": description,
+		"CanModerate": canModerate,
+		"CanWatch":    len(watch) > 0,
+		"Watching":    watch["Watching"],
+		"WatchDepth":  watch["WatchDepth"],
+		"WatchPath":   watch["WatchPath"],
+		"PagePath":    joinPath(path),
+		"Sort":        order,
+		"SortOrders":  sortOrders,
 	}
 
 	render(w, r, "home", data)
@@ -464,20 +642,38 @@ func getTextId(r *http.Request) int {
 	return id
 }
 
-func getPath(r *http.Request) []int {
-	vars := mux.Vars(r)
-	rawPath := vars["path"]
-	segments := strings.Split(rawPath, "/")
+// Returns the user whose profile a post is left on, when that is not the
+// author's own profile. Reports false if the post is meant for a profile
+// whose owner does not let others post there.
+func postProfile(r *http.Request, pageId int, userId int) (sql.NullInt64, bool) {
+	if pageId != ProfilePageID {
+		return sql.NullInt64{}, true
+	}
+	profileId, err := strconv.Atoi(r.FormValue("profile_id"))
+	if err != nil || profileId == userId {
+		return sql.NullInt64{}, true
+	}
+	if !isProfileOpen(r.Context(), profileId) {
+		return sql.NullInt64{}, false
+	}
+	return sql.NullInt64{Int64: int64(profileId), Valid: true}, true
+}
 
-	var ids []int
-	for _, s := range segments {
-		id, err := strconv.Atoi(s)
-		if err != nil {
-			return nil
-		}
-		ids = append(ids, id)
+func isProfileOpen(ctx context.Context, userId int) bool {
+	var open int
+
+	row, cancel := database.QueryRowWithTimeout(ctx, `SELECT COALESCE(open_profile, 0) FROM users WHERE id = ?`, userId)
+	defer cancel()
+
+	if err := row.Scan(&open); err != nil {
+		return false
 	}
-	return ids
+	return open == 1
+}
+
+func getPath(r *http.Request) []int {
+	vars := mux.Vars(r)
+	return parsePath(vars["path"])
 }
 
 func getSourcePath(r *http.Request) string {
@@ -493,10 +689,27 @@ func getSourcePath(r *http.Request) string {
 	return strings.Join(segments[:len(segments)-1], "/")
 }
 
-func getUsername(userId int) string {
+// Resolves a page title, following aliases left behind by merges
+func lookupPageId(ctx context.Context, title string) (int, error) {
+	var pageId int
+
+	slug := database.Slugify(title)
+	row, cancel := database.QueryRowWithTimeout(ctx, `
+		SELECT id FROM pages WHERE slug = ?
+		UNION ALL
+		SELECT page_id FROM page_aliases WHERE alias = ?
+		LIMIT 1
+	`, slug, slug)
+	defer cancel()
+
+	err := row.Scan(&pageId)
+	return pageId, err
+}
+
+func getUsername(ctx context.Context, userId int) string {
 	var username string
 
-	row, cancel := database.QueryRowWithTimeout("SELECT username FROM users WHERE id = ?", userId)
+	row, cancel := database.QueryRowWithTimeout(ctx, "SELECT username FROM users WHERE id = ?", userId)
 	defer cancel()
 
 	err := row.Scan(&username)
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"postpath/config"
+	"postpath/database"
+	"postpath/storage"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Builds an htmx request for a text route as the given signed-in user
+func textRequest(method string, pageId int, textId int, userId int, form url.Values) *http.Request {
+	r := httptest.NewRequest(method, "/editText/"+strconv.Itoa(pageId)+"/"+strconv.Itoa(textId), strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("HX-Request", "true")
+	r = mux.SetURLVars(r, map[string]string{"pageId": strconv.Itoa(pageId), "textId": strconv.Itoa(textId)})
+	ctx := context.WithValue(r.Context(), userContextKey, "user"+strconv.Itoa(userId))
+	ctx = context.WithValue(ctx, userIDContextKey, userId)
+	return r.WithContext(ctx)
+}
+
+// Stores an upload and attaches it to a text, returning its key
+func createTestAttachment(tb testing.TB, textId int, userId int) string {
+	tb.Helper()
+	key := "text" + strconv.Itoa(textId) + ".png"
+	if err := uploads.Put(context.Background(), key, strings.NewReader("image")); err != nil {
+		tb.Fatal(err)
+	}
+	_, err := database.DB().Exec(
+		`INSERT INTO attachments (text_id, user_id, storage_key, thumb_key, width, height, size) VALUES (?, ?, ?, ?, 1, 1, 5)`,
+		textId, userId, key, key,
+	)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return key
+}
+
+func uploadExists(tb testing.TB, key string) bool {
+	tb.Helper()
+	f, err := uploads.Get(context.Background(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false
+	} else if err != nil {
+		tb.Fatal(err)
+	}
+	f.Close()
+	return true
+}
+
+func setupTestStorage(tb testing.TB) {
+	tb.Helper()
+	local, err := storage.NewLocal(tb.TempDir())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	previous := uploads
+	SetupStorage(local)
+	tb.Cleanup(func() { SetupStorage(previous) })
+}
+
+// Only the author can delete a text, and another user's attempt leaves its
+// stored files alone
+func TestDeleteTextOwnership(t *testing.T) {
+	openTestDB(t)
+	setupTestStorage(t)
+	author := createTestUser(t, "author")
+	other := createTestUser(t, "other")
+	textId := createTestText(t, HomePageID, author, 0)
+	key := createTestAttachment(t, textId, author)
+
+	w := httptest.NewRecorder()
+	DeleteTextHandler(w, textRequest("DELETE", HomePageID, textId, other, nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("delete by another user: status %d, want 404", w.Code)
+	}
+	if !textExists(context.Background(), textId) || !uploadExists(t, key) {
+		t.Fatal("delete by another user removed the text or its upload")
+	}
+
+	w = httptest.NewRecorder()
+	DeleteTextHandler(w, textRequest("DELETE", HomePageID, textId, author, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete by the author: status %d, want 200", w.Code)
+	}
+	if textExists(context.Background(), textId) || uploadExists(t, key) {
+		t.Fatal("delete by the author left the text or its upload")
+	}
+}
+
+// Only the author can edit a text, and an empty edit by another user does
+// not delete it
+func TestUpdateTextOwnership(t *testing.T) {
+	openTestDB(t)
+	setupTestStorage(t)
+	author := createTestUser(t, "author")
+	other := createTestUser(t, "other")
+	textId := createTestText(t, HomePageID, author, 0)
+
+	for _, text := range []string{"rewritten", ""} {
+		w := httptest.NewRecorder()
+		UpdateTextHandler(w, textRequest("PUT", HomePageID, textId, other, url.Values{"text": {text}}))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("edit %q by another user: status %d, want 404", text, w.Code)
+		}
+	}
+
+	var text string
+	var revision int
+	if err := database.DB().QueryRow(`SELECT text, revision FROM pagetext WHERE id = ?`, textId).Scan(&text, &revision); err != nil {
+		t.Fatal(err)
+	}
+	if text != "text" || revision != 0 {
+		t.Errorf("text %q at revision %d after edits by another user, want it unchanged", text, revision)
+	}
+}
+
+// Posts meant for another user's profile are refused until its owner opens it
+func TestPostProfile(t *testing.T) {
+	openTestDB(t)
+	owner := createTestUser(t, "owner")
+	visitor := createTestUser(t, "visitor")
+
+	post := func(profileId int) *http.Request {
+		r := httptest.NewRequest("POST", "/addText/"+strconv.Itoa(ProfilePageID), strings.NewReader("profile_id="+strconv.Itoa(profileId)))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	if profile, ok := postProfile(post(visitor), ProfilePageID, visitor); !ok || profile.Valid {
+		t.Errorf("own profile: %v %v, want a plain post", profile, ok)
+	}
+	if _, ok := postProfile(post(owner), ProfilePageID, visitor); ok {
+		t.Error("closed profile accepted a post from another user")
+	}
+
+	if _, err := database.DB().Exec(`UPDATE users SET open_profile = 1 WHERE id = ?`, owner); err != nil {
+		t.Fatal(err)
+	}
+	if profile, ok := postProfile(post(owner), ProfilePageID, visitor); !ok || profile.Int64 != int64(owner) {
+		t.Errorf("open profile: %v %v, want a post on the owner's profile", profile, ok)
+	}
+	if profile, ok := postProfile(post(owner), HomePageID, visitor); !ok || profile.Valid {
+		t.Errorf("home page: %v %v, want a plain post", profile, ok)
+	}
+}
+
+// Parses the real templates so handlers that render can be tested
+func loadTestTemplates(tb testing.TB) {
+	tb.Helper()
+	SetupHelpers("../templates/*.gohtml", []byte("test session key"), config.Default())
+}
@@ -0,0 +1,492 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"postpath/database"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Link preview states
+const (
+	PreviewPending = "pending"
+	PreviewReady   = "ready"
+	PreviewFailed  = "failed"
+)
+
+const (
+	// Time allowed for a whole fetch, redirects included
+	previewTimeout = 5 * time.Second
+	// Bytes of a page read while looking for its metadata
+	maxPreviewBytes     = 512 << 10
+	maxPreviewRedirects = 3
+	// How long a fetched preview is used before it is fetched again
+	previewTTL = 7 * 24 * time.Hour
+	// URLs waiting for a worker before new ones are dropped
+	previewQueueSize = 256
+	previewWorkers   = 2
+	// Times a pending card asks for its preview before giving up
+	maxPreviewPolls       = 5
+	maxPreviewTitle       = 200
+	maxPreviewDescription = 300
+)
+
+var errBlockedAddress = errors.New("address is not publicly routable")
+
+// Address ranges netip does not already classify as private or local
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+var previewQueue = make(chan string, previewQueueSize)
+
+var previewClient = newPreviewClient(func(addr netip.AddrPort) bool {
+	return isPublicAddr(addr.Addr())
+})
+
+// Lets shutdown cancel the preview workers and wait for them
+var (
+	stopPreviews  context.CancelFunc = func() {}
+	previewsGroup sync.WaitGroup
+)
+
+type LinkPreview struct {
+	URL         string
+	Status      string
+	Title       string
+	Description string
+	ImageURL    string
+	SiteName    string
+	// Times the card has polled for a pending preview
+	Poll int
+}
+
+func (p LinkPreview) Ready() bool {
+	return p.Status == PreviewReady
+}
+
+func (p LinkPreview) Pending() bool {
+	return p.Status == PreviewPending && p.Poll < maxPreviewPolls
+}
+
+// The site shown on the card, falling back to the URL's host
+func (p LinkPreview) Site() string {
+	if p.SiteName != "" {
+		return p.SiteName
+	}
+	if u, err := url.Parse(p.URL); err == nil {
+		return u.Hostname()
+	}
+	return ""
+}
+
+// Starts the workers that fetch link previews and requeues any previews that
+// were still pending when the server last stopped
+func StartLinkPreviews(ctx context.Context) {
+	ctx, stopPreviews = context.WithCancel(ctx)
+	for i := 0; i < previewWorkers; i++ {
+		previewsGroup.Add(1)
+		go func() {
+			defer previewsGroup.Done()
+			previewWorker(ctx)
+		}()
+	}
+
+	rows, cancel, err := database.QueryWithTimeout(ctx, `SELECT url FROM link_previews WHERE status = ?`, PreviewPending)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query pending link previews", "err", err)
+		return
+	}
+	defer cancel()
+	defer rows.Close()
+
+	var pending []string
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err == nil {
+			pending = append(pending, u)
+		}
+	}
+	go func() {
+		for _, u := range pending {
+			select {
+			case previewQueue <- u:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stops the preview workers, waiting for any fetch in progress. Unfinished
+// previews stay pending and are fetched after the next start.
+func StopLinkPreviews() {
+	stopPreviews()
+	previewsGroup.Wait()
+}
+
+// Returns the preview card of a text, which polls until its fetch finishes
+func LinkPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	textId := getTextId(r)
+	if textId == -1 {
+		htmxError(w, "TextID missing", http.StatusNotFound)
+		return
+	}
+
+	var text string
+	row, cancel := database.QueryRowWithTimeout(r.Context(), `SELECT text FROM pagetext WHERE id = ? AND link_id IS NULL`, textId)
+	defer cancel()
+	if err := row.Scan(&text); err != nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	poll, _ := strconv.Atoi(r.URL.Query().Get("poll"))
+	preview := getLinkPreview(r.Context(), text)
+	if preview != nil {
+		preview.Poll = poll + 1
+	}
+	render(w, r, "linkpreview", map[string]any{"TextID": textId, "Preview": preview})
+}
+
+// Helper Functions
+
+// Returns the first URL in a post that is not inside code
+func previewURL(text string) string {
+	inFence := false
+	for _, line := range strings.Split(text, "\n") {
+		if fencePattern.MatchString(line) {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			continue
+		}
+		for _, token := range tokenPattern.FindAllString(line, -1) {
+			if urlPattern.FindString(token) == token {
+				return token
+			}
+		}
+	}
+	return ""
+}
+
+// Queues a fetch for the post's link unless a fresh preview is cached
+func queueLinkPreview(ctx context.Context, text string) {
+	u := previewURL(text)
+	if u == "" || !settings.Features.LinkPreviews {
+		return
+	}
+
+	var queued string
+	row, cancel := database.QueryRowWithTimeout(ctx, `
+		INSERT INTO link_previews (url, status) VALUES (?, ?)
+		ON CONFLICT (url) DO UPDATE SET status = excluded.status
+		WHERE link_previews.status <> ? AND link_previews.fetched_at < ?
+		RETURNING url
+	`, u, PreviewPending, PreviewPending, time.Now().Add(-previewTTL))
+	defer cancel()
+	if err := row.Scan(&queued); err != nil {
+		if err != sql.ErrNoRows {
+			slog.ErrorContext(ctx, "Failed to queue link preview", "err", err)
+		}
+		return
+	}
+
+	select {
+	case previewQueue <- u:
+	default:
+		// Leave nothing pending so the next post of the link tries again
+		if _, cancel, err := database.ExecWithTimeout(ctx, `DELETE FROM link_previews WHERE url = ? AND status = ?`, u, PreviewPending); err == nil {
+			cancel()
+		}
+	}
+}
+
+// Returns the cached preview for the post's link, if there is one
+func getLinkPreview(ctx context.Context, text string) *LinkPreview {
+	u := previewURL(text)
+	if u == "" {
+		return nil
+	}
+	previews := getLinkPreviews(ctx, []string{u})
+	if preview, ok := previews[u]; ok {
+		return &preview
+	}
+	return nil
+}
+
+// Returns the cached previews of a set of URLs, keyed by URL
+func getLinkPreviews(ctx context.Context, urls []string) map[string]LinkPreview {
+	previews := map[string]LinkPreview{}
+	if len(urls) == 0 || !settings.Features.LinkPreviews {
+		return previews
+	}
+
+	args := make([]any, len(urls))
+	for i, u := range urls {
+		args[i] = u
+	}
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT url, status, title, description, image_url, site_name
+		FROM link_previews
+		WHERE url IN (?`+strings.Repeat(", ?", len(urls)-1)+`)
+	`, args...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query link previews", "err", err)
+		return previews
+	}
+	defer cancel()
+	defer rows.Close()
+
+	for rows.Next() {
+		var p LinkPreview
+		if err := rows.Scan(&p.URL, &p.Status, &p.Title, &p.Description, &p.ImageURL, &p.SiteName); err != nil {
+			continue
+		}
+		previews[p.URL] = p
+	}
+	return previews
+}
+
+// Fills in the link previews of texts and their replies
+func addLinkPreviews(ctx context.Context, texts []PageText) {
+	var urls []string
+	var collect func(texts []PageText)
+	collect = func(texts []PageText) {
+		for _, pt := range texts {
+			if u := previewURL(pt.Text); u != "" && pt.LinkID == 0 {
+				urls = append(urls, u)
+			}
+			collect(pt.Replies)
+		}
+	}
+	collect(texts)
+
+	previews := getLinkPreviews(ctx, urls)
+	var attach func(texts []PageText)
+	attach = func(texts []PageText) {
+		for i := range texts {
+			if texts[i].LinkID == 0 {
+				if preview, ok := previews[previewURL(texts[i].Text)]; ok {
+					texts[i].Preview = &preview
+				}
+			}
+			attach(texts[i].Replies)
+		}
+	}
+	attach(texts)
+}
+
+func previewWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case u := <-previewQueue:
+			preview, err := fetchLinkPreview(ctx, u)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				// Errors name the URL, which is post content, so keep them out of info logs
+				slog.DebugContext(ctx, "Link preview failed", "err", err)
+				preview = LinkPreview{URL: u, Status: PreviewFailed}
+			}
+			_, cancel, err := database.ExecWithTimeout(ctx, `
+				UPDATE link_previews
+				SET status = ?, title = ?, description = ?, image_url = ?, site_name = ?, fetched_at = ?
+				WHERE url = ?
+			`, preview.Status, preview.Title, preview.Description, preview.ImageURL, preview.SiteName, time.Now(), u)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to save link preview", "err", err)
+				continue
+			}
+			cancel()
+		}
+	}
+}
+
+// An HTTP client that only connects to addresses allowed accepts, which for
+// previews are the public ones. The check runs on the resolved address of
+// every connection, redirects included, so DNS answers cannot point it back
+// at the internal network.
+func newPreviewClient(allowed func(netip.AddrPort) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: previewTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !allowed(addrPort) {
+				return fmt.Errorf("%s: %w", address, errBlockedAddress)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: previewTimeout,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   previewTimeout,
+			ResponseHeaderTimeout: previewTimeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxPreviewRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("redirect to unsupported scheme")
+			}
+			return nil
+		},
+	}
+}
+
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func fetchLinkPreview(ctx context.Context, rawURL string) (LinkPreview, error) {
+	preview := LinkPreview{URL: rawURL, Status: PreviewFailed}
+
+	ctx, cancel := context.WithTimeout(ctx, previewTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return preview, err
+	}
+	req.Header.Set("User-Agent", "PostPath link preview")
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := previewClient.Do(req)
+	if err != nil {
+		return preview, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return preview, fmt.Errorf("%s: status %d", rawURL, resp.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return preview, fmt.Errorf("%s: not an HTML page", rawURL)
+	}
+
+	meta := parsePreviewMeta(io.LimitReader(resp.Body, maxPreviewBytes))
+	preview.Title = truncateRunes(firstNonEmpty(meta["og:title"], meta["twitter:title"], meta["title"]), maxPreviewTitle)
+	preview.Description = truncateRunes(firstNonEmpty(meta["og:description"], meta["twitter:description"], meta["description"]), maxPreviewDescription)
+	preview.SiteName = truncateRunes(meta["og:site_name"], maxPreviewTitle)
+	if image := firstNonEmpty(meta["og:image"], meta["twitter:image"]); image != "" {
+		// Relative images resolve against the page the redirects ended on
+		if ref, err := resp.Request.URL.Parse(image); err == nil && (ref.Scheme == "http" || ref.Scheme == "https") {
+			preview.ImageURL = ref.String()
+		}
+	}
+
+	if preview.Title == "" && preview.Description == "" {
+		return preview, fmt.Errorf("%s: no preview metadata", rawURL)
+	}
+	preview.Status = PreviewReady
+	return preview, nil
+}
+
+// Collects the OpenGraph, Twitter card and plain meta tags of a page's head
+func parsePreviewMeta(r io.Reader) map[string]string {
+	meta := map[string]string{}
+	z := html.NewTokenizer(r)
+	inTitle := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return meta
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			switch token.Data {
+			case "body":
+				return meta
+			case "title":
+				inTitle = true
+			case "meta":
+				var key, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						if key == "" {
+							key = strings.ToLower(attr.Val)
+						}
+					case "content":
+						content = strings.TrimSpace(attr.Val)
+					}
+				}
+				if key != "" && content != "" && meta[key] == "" {
+					meta[key] = content
+				}
+			}
+		case html.TextToken:
+			if inTitle && meta["title"] == "" {
+				meta["title"] = strings.TrimSpace(string(z.Text()))
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				return meta
+			}
+		}
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func truncateRunes(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
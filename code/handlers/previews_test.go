@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"192.0.0.8", false},
+		{"198.18.0.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"64:ff9b::7f00:1", false},
+		{"2001:db8::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:93.184.216.34", true},
+	}
+	for _, test := range tests {
+		t.Run(test.addr, func(t *testing.T) {
+			if got := isPublicAddr(netip.MustParseAddr(test.addr)); got != test.public {
+				t.Errorf("isPublicAddr(%s) = %v, want %v", test.addr, got, test.public)
+			}
+		})
+	}
+}
+
+func TestParsePreviewMeta(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		want map[string]string
+	}{
+		{
+			"open graph",
+			`<html><head><meta property="og:title" content=" A title "><meta property="og:image" content="/a.png"></head></html>`,
+			map[string]string{"og:title": "A title", "og:image": "/a.png"},
+		},
+		{
+			"title element and description",
+			`<head><title>Plain</title><meta name="Description" content="About it"></head>`,
+			map[string]string{"title": "Plain", "description": "About it"},
+		},
+		{
+			"first tag wins",
+			`<head><meta property="og:title" content="First"><meta property="og:title" content="Second"></head>`,
+			map[string]string{"og:title": "First"},
+		},
+		{
+			"empty content ignored",
+			`<head><meta property="og:title" content=""><meta property="og:title" content="Filled"></head>`,
+			map[string]string{"og:title": "Filled"},
+		},
+		{
+			"stops at the body",
+			`<head><title>Head</title></head><body><meta property="og:title" content="Body"></body>`,
+			map[string]string{"title": "Head"},
+		},
+		{
+			"not html",
+			`just some text`,
+			map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parsePreviewMeta(strings.NewReader(test.page))
+			if len(got) != len(test.want) {
+				t.Fatalf("parsePreviewMeta = %v, want %v", got, test.want)
+			}
+			for key, value := range test.want {
+				if got[key] != value {
+					t.Errorf("%s = %q, want %q", key, got[key], value)
+				}
+			}
+		})
+	}
+}
+
+// Swaps in a preview client that may only connect to the given servers,
+// standing in for the public internet
+func usePreviewClient(t *testing.T, servers ...*httptest.Server) {
+	t.Helper()
+	allowed := map[netip.AddrPort]bool{}
+	for _, server := range servers {
+		u, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		allowed[netip.MustParseAddrPort(u.Host)] = true
+	}
+	previous := previewClient
+	previewClient = newPreviewClient(func(addr netip.AddrPort) bool { return allowed[addr] })
+	t.Cleanup(func() { previewClient = previous })
+}
+
+func TestFetchLinkPreview(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<head><title>Internal</title></head>`))
+	}))
+	defer internal.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<head><title>Public</title><meta property="og:image" content="/image.png"></head>`))
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/page", http.StatusFound)
+	})
+	mux.HandleFunc("/internal", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL, http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/huge", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<head><meta name="filler" content="` + strings.Repeat("x", maxPreviewBytes) + `"><title>Too far</title></head>`))
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+	})
+	public := httptest.NewServer(mux)
+	defer public.Close()
+	usePreviewClient(t, public)
+	ctx := context.Background()
+
+	preview, err := fetchLinkPreview(ctx, public.URL+"/moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Status != PreviewReady || preview.Title != "Public" || preview.ImageURL != public.URL+"/image.png" {
+		t.Errorf("preview %+v, want a ready preview titled Public with an absolute image", preview)
+	}
+
+	if _, err := fetchLinkPreview(ctx, internal.URL); !errors.Is(err, errBlockedAddress) {
+		t.Errorf("fetching a blocked address: %v, want %v", err, errBlockedAddress)
+	}
+	if _, err := fetchLinkPreview(ctx, public.URL+"/internal"); !errors.Is(err, errBlockedAddress) {
+		t.Errorf("redirect to a blocked address: %v, want %v", err, errBlockedAddress)
+	}
+	if _, err := fetchLinkPreview(ctx, public.URL+"/loop"); err == nil || !strings.Contains(err.Error(), "too many redirects") {
+		t.Errorf("redirect loop: %v, want too many redirects", err)
+	}
+	if preview, err := fetchLinkPreview(ctx, public.URL+"/huge"); err == nil {
+		t.Errorf("metadata past the read limit was used: %+v", preview)
+	}
+	if _, err := fetchLinkPreview(ctx, public.URL+"/image"); err == nil {
+		t.Error("a non-HTML response produced a preview")
+	}
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"math"
+	"net/http"
+	"postpath/database"
+	"sort"
+	"time"
+)
+
+// The upvote is the reaction that ranks posts
+const ReactionUpvote = "up"
+
+// Orderings a page can be viewed in
+const (
+	SortChrono = "chrono"
+	SortNew    = "new"
+	SortTop    = "top"
+	SortHot    = "hot"
+)
+
+var sortOrders = []string{SortChrono, SortNew, SortTop, SortHot}
+
+// How quickly a post's hot score decays with age, as in Hacker News ranking
+const hotGravity = 1.8
+
+type Reaction struct {
+	Kind    string
+	Emoji   string
+	Count   int
+	Reacted bool
+}
+
+// The fixed set of reactions, in display order
+var reactionKinds = []Reaction{
+	{Kind: ReactionUpvote, Emoji: "▲"},
+	{Kind: "heart", Emoji: "❤️"},
+	{Kind: "laugh", Emoji: "😂"},
+	{Kind: "think", Emoji: "🤔"},
+	{Kind: "party", Emoji: "🎉"},
+}
+
+// Toggles the user's reaction of one kind on a text
+func ReactHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	textId := getTextId(r)
+	if textId == -1 || !textExists(r.Context(), textId) {
+		htmxError(w, "Text does not exist", http.StatusNotFound)
+		return
+	}
+
+	kind := r.FormValue("kind")
+	if !isReactionKind(kind) {
+		htmxError(w, "Unknown reaction", http.StatusBadRequest)
+		return
+	}
+
+	result, cancel, err := database.ExecWithTimeout(r.Context(), `DELETE FROM reactions WHERE user_id = ? AND text_id = ? AND kind = ?`, userId, textId, kind)
+	if err != nil {
+		htmxError(w, "Failed to update reaction", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+	if removed, err := result.RowsAffected(); err == nil && removed == 0 {
+		_, cancel, err := database.ExecWithTimeout(r.Context(), `INSERT INTO reactions (user_id, text_id, kind) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, userId, textId, kind)
+		if err != nil {
+			htmxError(w, "Failed to update reaction", http.StatusInternalServerError)
+			return
+		}
+		cancel()
+	}
+
+	data := map[string]any{
+		"TextID":    textId,
+		"Reactions": getTextReactions(r.Context(), textId, userId),
+	}
+	render(w, r, "reactions", data)
+}
+
+// Helper Functions
+
+func isReactionKind(kind string) bool {
+	for _, reaction := range reactionKinds {
+		if reaction.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func reactionCount(reactions []Reaction, kind string) int {
+	for _, reaction := range reactions {
+		if reaction.Kind == kind {
+			return reaction.Count
+		}
+	}
+	return 0
+}
+
+// Returns every reaction with no counts, for a text nobody has reacted to
+func emptyReactions() []Reaction {
+	reactions := make([]Reaction, len(reactionKinds))
+	copy(reactions, reactionKinds)
+	return reactions
+}
+
+// Returns the reaction counts for a text, marking those the viewer made
+func getTextReactions(ctx context.Context, textId int, viewerId int) []Reaction {
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT text_id, kind, COUNT(*), COALESCE(SUM(CASE WHEN user_id = ? THEN 1 ELSE 0 END), 0)
+		FROM reactions
+		WHERE text_id = ?
+		GROUP BY text_id, kind
+	`, viewerId, textId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query reactions", "text_id", textId, "err", err)
+		return emptyReactions()
+	}
+	defer cancel()
+	defer rows.Close()
+
+	if reactions, ok := scanReactions(rows)[textId]; ok {
+		return reactions
+	}
+	return emptyReactions()
+}
+
+// Returns the reaction counts for every text on a page, keyed by text id
+func getPageReactions(ctx context.Context, pageId int, viewerId int) map[int][]Reaction {
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT text_id, kind, COUNT(*), COALESCE(SUM(CASE WHEN user_id = ? THEN 1 ELSE 0 END), 0)
+		FROM reactions
+		WHERE text_id IN (SELECT id FROM pagetext WHERE page_id = ?)
+		GROUP BY text_id, kind
+	`, viewerId, pageId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query reactions", "page_id", pageId, "err", err)
+		return nil
+	}
+	defer cancel()
+	defer rows.Close()
+
+	return scanReactions(rows)
+}
+
+func scanReactions(rows *sql.Rows) map[int][]Reaction {
+	reactions := map[int][]Reaction{}
+	for rows.Next() {
+		var textId, count, reacted int
+		var kind string
+		if err := rows.Scan(&textId, &kind, &count, &reacted); err != nil {
+			continue
+		}
+		if reactions[textId] == nil {
+			reactions[textId] = emptyReactions()
+		}
+		for i := range reactions[textId] {
+			if reactions[textId][i].Kind == kind {
+				reactions[textId][i].Count = count
+				reactions[textId][i].Reacted = reacted > 0
+			}
+		}
+	}
+	return reactions
+}
+
+// Returns the requested page ordering, defaulting to chronological
+func getSort(r *http.Request) string {
+	switch order := r.URL.Query().Get("sort"); order {
+	case SortNew, SortTop, SortHot:
+		return order
+	}
+	return SortChrono
+}
+
+// Orders texts that arrive oldest first. Pinned texts always lead.
+func sortTexts(texts []PageText, order string) {
+	now := time.Now()
+	hot := func(pt PageText) float64 {
+		age := now.Sub(pt.CreatedAt).Hours()
+		return float64(pt.Upvotes) / math.Pow(math.Max(age, 0)+2, hotGravity)
+	}
+
+	sort.SliceStable(texts, func(i, j int) bool {
+		a, b := texts[i], texts[j]
+		if a.Pinned != b.Pinned {
+			return a.Pinned > b.Pinned
+		}
+		switch order {
+		case SortNew:
+			return a.CreatedAt.After(b.CreatedAt)
+		case SortTop:
+			if a.Upvotes != b.Upvotes {
+				return a.Upvotes > b.Upvotes
+			}
+			return a.CreatedAt.After(b.CreatedAt)
+		case SortHot:
+			if scoreA, scoreB := hot(a), hot(b); scoreA != scoreB {
+				return scoreA > scoreB
+			}
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return false
+	})
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"postpath/database"
+	"postpath/metrics"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Loads the inline editor for replying to a text
+func ReplyEditorHandler(w http.ResponseWriter, r *http.Request) {
+	textId := getTextId(r)
+	if textId == -1 {
+		htmxError(w, "TextID missing", http.StatusNotFound)
+		return
+	}
+	render(w, r, "replyeditor", map[string]any{"TextID": textId})
+}
+
+// Adds a reply below a text. Replies are always text; links stay the way to
+// move between pages.
+func ReplyHandler(w http.ResponseWriter, r *http.Request) {
+	user, userId := GetUserFromContext(r)
+
+	parentId := getTextId(r)
+	if parentId == -1 {
+		htmxError(w, "TextID missing", http.StatusNotFound)
+		return
+	}
+
+	var pageId, parentAuthorId, source int
+	var sourcePath string
+	var linkId sql.NullInt64
+	row, cancel := database.QueryRowWithTimeout(r.Context(), `
+		SELECT page_id, user_id, COALESCE(path, ''), COALESCE(source, 0), link_id
+		FROM pagetext WHERE id = ?
+	`, parentId)
+	defer cancel()
+	err := row.Scan(&pageId, &parentAuthorId, &sourcePath, &source, &linkId)
+	if err == sql.ErrNoRows {
+		htmxError(w, "Text does not exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		htmxError(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if linkId.Valid {
+		htmxError(w, "Links cannot be replied to", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		htmxError(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	text := strings.TrimSpace(r.FormValue("text"))
+	if text == "" {
+		htmxError(w, "Text cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(text) > settings.MaxPostLength {
+		htmxError(w, fmt.Sprintf("Text exceeds maximum length of %d characters", settings.MaxPostLength), http.StatusBadRequest)
+		return
+	}
+
+	linkIDs, err := ensureInlinePages(r.Context(), text, userId)
+	if err != nil {
+		htmxError(w, "Failed to create linked pages", http.StatusInternalServerError)
+		return
+	}
+
+	var textId int64
+	row, cancelInsert := database.QueryRowWithTimeout(r.Context(),
+		`INSERT INTO pagetext (page_id, user_id, text, link_id, created_at, path, source, parent_id) VALUES (?, ?, ?, NULL, ?, ?, ?, ?) RETURNING id`,
+		pageId, userId, text, time.Now(), sourcePath, source, parentId,
+	)
+	defer cancelInsert()
+	if err := row.Scan(&textId); err != nil {
+		htmxError(w, "Failed to insert reply", http.StatusInternalServerError)
+		return
+	}
+
+	if err := updateMentions(r.Context(), int(textId), pageId, userId, text); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save mentions", "text_id", textId, "err", err)
+	}
+	metrics.PostCreated("reply")
+	notifyReply(r.Context(), pageId, int(textId), userId, parentAuthorId, linkIDs)
+	queueLinkPreview(r.Context(), text)
+
+	data := map[string]any{
+		"PageID":       pageId,
+		"Text":         text,
+		"TextID":       int(textId),
+		"ParentID":     parentId,
+		"Path":         parsePath(pagePath(sourcePath, pageId)),
+		"UserID":       userId,
+		"User":         user,
+		"CreatedAtStr": time.Now().Format("2006-01-02 15:04"),
+		"Edited":       0,
+		"Revision":     0,
+		"Reactions":    emptyReactions(),
+		"Preview":      getLinkPreview(r.Context(), text),
+		"Mentions":     getTextMentions(r.Context(), int(textId))[int(textId)],
+	}
+	render(w, r, "thread", data)
+	if pageId != ProfilePageID {
+		publishFragment(r.Context(), pageId, userId, EventUpdate, "replyappend", data)
+	}
+}
+
+// Helper Functions
+
+// Returns every reply on a page grouped by the text replied to, oldest first
+func getPageReplies(ctx context.Context, pageId int, path []int) map[int][]PageText {
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT
+			pagetext.id,
+			pagetext.parent_id,
+			pagetext.text,
+			users.id,
+			users.username,
+			pagetext.created_at,
+			pagetext.is_edited,
+			pagetext.revision
+		FROM pagetext
+		INNER JOIN users ON pagetext.user_id = users.id
+		WHERE pagetext.page_id = ? AND pagetext.parent_id IS NOT NULL
+		ORDER BY pagetext.created_at ASC
+	`, pageId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query replies", "page_id", pageId, "err", err)
+		return nil
+	}
+	defer cancel()
+	defer rows.Close()
+
+	replies := map[int][]PageText{}
+	for rows.Next() {
+		var pt PageText
+		var createdAt time.Time
+		if err := rows.Scan(
+			&pt.TextID, &pt.ParentID, &pt.Text, &pt.UserID, &pt.User,
+			&createdAt, &pt.Edited, &pt.Revision,
+		); err != nil {
+			continue
+		}
+		pt.PageID = pageId
+		pt.Path = path
+		pt.CreatedAt = createdAt
+		pt.CreatedAtStr = createdAt.Format("2006-01-02 15:04")
+		replies[pt.ParentID] = append(replies[pt.ParentID], pt)
+	}
+	return replies
+}
+
+// Nests replies below the texts they answer and counts each thread. Returns
+// the number of replies attached below the given texts.
+func attachReplies(texts []PageText, replies map[int][]PageText) int {
+	total := 0
+	for i := range texts {
+		children := replies[texts[i].TextID]
+		if len(children) == 0 {
+			continue
+		}
+		texts[i].Replies = children
+		texts[i].ReplyCount = len(children) + attachReplies(children, replies)
+		total += texts[i].ReplyCount
+	}
+	return total
+}
+
+// Fills in the reactions, attachments and mentions of texts and their replies
+func addTextDetails(texts []PageText, reactions map[int][]Reaction, attachments map[int][]Attachment, mentions map[int]map[string]int) {
+	for i := range texts {
+		texts[i].Reactions = emptyReactions()
+		if counts, ok := reactions[texts[i].TextID]; ok {
+			texts[i].Reactions = counts
+		}
+		texts[i].Upvotes = reactionCount(texts[i].Reactions, ReactionUpvote)
+		texts[i].Attachments = attachments[texts[i].TextID]
+		texts[i].Mentions = mentions[texts[i].TextID]
+		addTextDetails(texts[i].Replies, reactions, attachments, mentions)
+	}
+}
+
+// Returns the owner of the profile whose thread a reply belongs to: the
+// user the top-level text was left for, or else its author
+func getThreadProfile(ctx context.Context, textId int) int {
+	ownerId, err := database.ThreadProfile(ctx, textId)
+	if err != nil {
+		return 0
+	}
+	return ownerId
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"postpath/database"
+	"slices"
+	"testing"
+)
+
+// Loads the replies of a page of 100 threads, each a chain of 10 replies
+func BenchmarkThreadQuery(b *testing.B) {
+	openTestDB(b)
+	userId := createTestUser(b, "bench")
+	pageId := createTestPage(b, "bench")
+	for thread := 0; thread < 100; thread++ {
+		parentId := createTestText(b, pageId, userId, 0)
+		for reply := 0; reply < 10; reply++ {
+			parentId = createTestText(b, pageId, userId, parentId)
+		}
+	}
+	ctx := context.Background()
+	path := []int{HomePageID, pageId}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if replies := getPageReplies(ctx, pageId, path); len(replies) != 1000 {
+			b.Fatalf("got replies to %d texts, want 1000", len(replies))
+		}
+	}
+}
+
+// Replies nest below the texts they answer, and each thread counts every
+// reply below it
+func TestAttachReplies(t *testing.T) {
+	openTestDB(t)
+	author := createTestUser(t, "author")
+	replier := createTestUser(t, "replier")
+	pageId := createTestPage(t, "threads")
+	top := createTestText(t, pageId, author, 0)
+	first := createTestText(t, pageId, replier, top)
+	second := createTestText(t, pageId, author, top)
+	nested := createTestText(t, pageId, author, first)
+	quiet := createTestText(t, pageId, replier, 0)
+
+	texts := []PageText{{TextID: top}, {TextID: quiet}}
+	path := []int{HomePageID, pageId}
+	if total := attachReplies(texts, getPageReplies(context.Background(), pageId, path)); total != 3 {
+		t.Errorf("attached %d replies, want 3", total)
+	}
+
+	thread := texts[0]
+	if thread.ReplyCount != 3 || len(thread.Replies) != 2 {
+		t.Fatalf("thread has %d replies below it and %d direct ones, want 3 and 2", thread.ReplyCount, len(thread.Replies))
+	}
+	if thread.Replies[0].TextID != first || thread.Replies[1].TextID != second {
+		t.Errorf("direct replies %d, %d, want %d, %d in the order posted", thread.Replies[0].TextID, thread.Replies[1].TextID, first, second)
+	}
+	if replies := thread.Replies[0].Replies; thread.Replies[0].ReplyCount != 1 || len(replies) != 1 || replies[0].TextID != nested {
+		t.Errorf("first reply has replies %+v, want only %d", replies, nested)
+	}
+	if thread.Replies[0].ParentID != top || thread.Replies[0].User != "replier" || !slices.Equal(thread.Replies[0].Path, path) {
+		t.Errorf("first reply %+v, want it by replier below %d on path %v", thread.Replies[0], top, path)
+	}
+	if texts[1].ReplyCount != 0 || texts[1].Replies != nil {
+		t.Errorf("text without replies has %d", texts[1].ReplyCount)
+	}
+}
+
+func TestReplyHandler(t *testing.T) {
+	openTestDB(t)
+	loadTestTemplates(t)
+	author := createTestUser(t, "author")
+	replier := createTestUser(t, "replier")
+	pageId := createTestPage(t, "threads")
+	textId := createTestText(t, pageId, author, 0)
+	linkTarget := createTestPage(t, "elsewhere")
+	createTestLink(t, pageId, author, linkTarget)
+	var linkId int
+	if err := database.DB().QueryRow(`SELECT id FROM pagetext WHERE link_id = ?`, linkTarget).Scan(&linkId); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := func(parentId int, text string) int {
+		w := httptest.NewRecorder()
+		ReplyHandler(w, textRequest("POST", pageId, parentId, replier, url.Values{"text": {text}}))
+		return w.Code
+	}
+
+	if code := reply(linkId, "a reply"); code != http.StatusBadRequest {
+		t.Errorf("reply to a link: status %d, want 400", code)
+	}
+	if code := reply(9999, "a reply"); code != http.StatusNotFound {
+		t.Errorf("reply to a missing text: status %d, want 404", code)
+	}
+	if code := reply(textId, "   "); code != http.StatusBadRequest {
+		t.Errorf("empty reply: status %d, want 400", code)
+	}
+	var replies int
+	if err := database.DB().QueryRow(`SELECT COUNT(*) FROM pagetext WHERE parent_id IS NOT NULL`).Scan(&replies); err != nil {
+		t.Fatal(err)
+	}
+	if replies != 0 {
+		t.Fatalf("%d replies saved from refused requests", replies)
+	}
+
+	if code := reply(textId, "a reply"); code != http.StatusOK {
+		t.Fatalf("reply: status %d, want 200", code)
+	}
+	var replyPage, replyAuthor int
+	err := database.DB().QueryRow(`SELECT page_id, user_id FROM pagetext WHERE parent_id = ?`, textId).Scan(&replyPage, &replyAuthor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replyPage != pageId || replyAuthor != replier {
+		t.Errorf("reply on page %d by %d, want page %d by %d", replyPage, replyAuthor, pageId, replier)
+	}
+	if notifications := getNotifications(context.Background(), author); len(notifications) != 1 || notifications[0].Kind != NotificationReply {
+		t.Errorf("author notifications %+v, want one reply notification", notifications)
+	}
+}
+
+// Deleting a text takes every reply below it along, whoever wrote them
+func TestDeleteTextCascadesToReplies(t *testing.T) {
+	openTestDB(t)
+	setupTestStorage(t)
+	author := createTestUser(t, "author")
+	replier := createTestUser(t, "replier")
+	pageId := createTestPage(t, "threads")
+	top := createTestText(t, pageId, author, 0)
+	reply := createTestText(t, pageId, replier, top)
+	nested := createTestText(t, pageId, author, reply)
+	key := createTestAttachment(t, nested, author)
+	other := createTestText(t, pageId, replier, 0)
+
+	w := httptest.NewRecorder()
+	DeleteTextHandler(w, textRequest("DELETE", pageId, top, author, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d, want 200", w.Code)
+	}
+
+	ctx := context.Background()
+	for _, id := range []int{top, reply, nested} {
+		if textExists(ctx, id) {
+			t.Errorf("text %d survived deleting the thread", id)
+		}
+	}
+	if !textExists(ctx, other) {
+		t.Error("a text outside the thread was deleted")
+	}
+	if uploadExists(t, key) {
+		t.Error("a nested reply's upload survived deleting the thread")
+	}
+}
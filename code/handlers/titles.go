@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"postpath/database"
+	"strings"
+	"sync"
+)
+
+// Page titles kept in memory, least recently used dropped first
+const maxTitleCacheEntries = 10000
+
+// Titles never change once a page exists, so an entry only goes stale when
+// a merge deletes its page
+var titleCache = newTitleLRU(maxTitleCacheEntries)
+
+type titleLRU struct {
+	sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[int]*list.Element
+}
+
+type titleEntry struct {
+	id    int
+	title string
+}
+
+func newTitleLRU(capacity int) *titleLRU {
+	return &titleLRU{capacity: capacity, order: list.New(), entries: map[int]*list.Element{}}
+}
+
+func (c *titleLRU) get(id int) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	element, ok := c.entries[id]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*titleEntry).title, true
+}
+
+func (c *titleLRU) add(id int, title string) {
+	c.Lock()
+	defer c.Unlock()
+	if element, ok := c.entries[id]; ok {
+		element.Value.(*titleEntry).title = title
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[id] = c.order.PushFront(&titleEntry{id: id, title: title})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*titleEntry).id)
+	}
+}
+
+func (c *titleLRU) remove(id int) {
+	c.Lock()
+	defer c.Unlock()
+	if element, ok := c.entries[id]; ok {
+		c.order.Remove(element)
+		delete(c.entries, id)
+	}
+}
+
+// Returns the titles of the given pages, keyed by id. Pages that do not
+// exist are left out. Titles missing from the cache are read in one query.
+func getPageTitles(ctx context.Context, ids []int) (map[int]string, error) {
+	titles := make(map[int]string, len(ids))
+	// Paths can pass through a page more than once
+	queued := map[int]bool{}
+	var missing []any
+	for _, id := range ids {
+		if _, ok := titles[id]; ok || queued[id] {
+			continue
+		}
+		if title, ok := titleCache.get(id); ok {
+			titles[id] = title
+			continue
+		}
+		queued[id] = true
+		missing = append(missing, id)
+	}
+	if len(missing) == 0 {
+		return titles, nil
+	}
+
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT id, title FROM pages WHERE id IN (?`+strings.Repeat(", ?", len(missing)-1)+`)
+	`, missing...)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var title string
+		if err := rows.Scan(&id, &title); err != nil {
+			return nil, err
+		}
+		titles[id] = title
+		titleCache.add(id, title)
+	}
+	return titles, rows.Err()
+}
+
+// Returns the title of each page on a path, in path order. ok is false when
+// any page on the path does not exist or is not linked from the page before.
+func getPathTitles(ctx context.Context, path []int) ([]PageTitle, bool, error) {
+	titles, err := getPageTitles(ctx, path)
+	if err != nil {
+		return nil, false, err
+	}
+	pageTitles := make([]PageTitle, 0, len(path))
+	for _, id := range path {
+		title, ok := titles[id]
+		if !ok {
+			return nil, false, nil
+		}
+		pageTitles = append(pageTitles, PageTitle{ID: id, Title: title})
+	}
+
+	linked, err := pathLinked(ctx, path)
+	if err != nil || !linked {
+		return nil, false, err
+	}
+	return pageTitles, true, nil
+}
+
+// Reports whether each page on a path is linked from the page before it,
+// by a link post or an inline reference. Link posts for every step are
+// read in one query; inline references are only searched for the steps
+// no link post covers.
+func pathLinked(ctx context.Context, path []int) (bool, error) {
+	type step struct{ from, to int }
+	var steps []step
+	seen := map[step]bool{}
+	var froms, tos []any
+	for i := 1; i < len(path); i++ {
+		s := step{path[i-1], path[i]}
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		steps = append(steps, s)
+		froms = append(froms, s.from)
+		tos = append(tos, s.to)
+	}
+	if len(steps) == 0 {
+		return true, nil
+	}
+
+	// Pairs of pages off the path may match too; only the steps are checked
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT DISTINCT page_id, link_id FROM pagetext
+		WHERE link_id IN (?`+strings.Repeat(", ?", len(tos)-1)+`)
+		AND page_id IN (?`+strings.Repeat(", ?", len(froms)-1)+`)
+	`, append(tos, froms...)...)
+	if err != nil {
+		return false, err
+	}
+	defer cancel()
+	defer rows.Close()
+
+	linked := map[step]bool{}
+	for rows.Next() {
+		var s step
+		if err := rows.Scan(&s.from, &s.to); err != nil {
+			return false, err
+		}
+		linked[s] = true
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	for _, s := range steps {
+		if linked[s] {
+			continue
+		}
+		referenced, err := referencedInline(ctx, s.from, s.to)
+		if err != nil || !referenced {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Reports whether a text on one page references another page inline, by
+// its title or by an alias a merge left behind
+func referencedInline(ctx context.Context, pageId int, linkId int) (bool, error) {
+	slugs := map[string]bool{}
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT slug FROM pages WHERE id = ? AND slug IS NOT NULL
+		UNION
+		SELECT alias FROM page_aliases WHERE page_id = ?
+	`, linkId, linkId)
+	if err != nil {
+		return false, err
+	}
+	defer cancel()
+	defer rows.Close()
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return false, err
+		}
+		slugs[slug] = true
+	}
+	if err := rows.Err(); err != nil || len(slugs) == 0 {
+		return false, err
+	}
+
+	texts, cancelTexts, err := database.QueryWithTimeout(ctx, `
+		SELECT text FROM pagetext WHERE page_id = ? AND text LIKE '%[[%'
+	`, pageId)
+	if err != nil {
+		return false, err
+	}
+	defer cancelTexts()
+	defer texts.Close()
+	for texts.Next() {
+		var text string
+		if err := texts.Scan(&text); err != nil {
+			return false, err
+		}
+		for _, title := range inlineLinks(text) {
+			if slugs[database.Slugify(title)] {
+				return true, nil
+			}
+		}
+	}
+	return false, texts.Err()
+}
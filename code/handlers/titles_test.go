@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"postpath/database"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Adds a link post on one page leading to another
+func createTestLink(tb testing.TB, pageId int, userId int, linkId int) {
+	tb.Helper()
+	_, err := database.DB().Exec(
+		`INSERT INTO pagetext (page_id, user_id, text, link_id, created_at, path, source) VALUES (?, ?, 'link', ?, ?, '0', 0)`,
+		pageId, userId, linkId, time.Now(),
+	)
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestGetPathTitles(t *testing.T) {
+	openTestDB(t)
+	userId := createTestUser(t, "alice")
+	fruit := createTestPage(t, "fruit")
+	apples := createTestPage(t, "apples")
+	pears := createTestPage(t, "green pears")
+	createTestLink(t, HomePageID, userId, fruit)
+	createTestLink(t, fruit, userId, apples)
+	textId := createTestText(t, apples, userId, 0)
+	if _, err := database.DB().Exec(`UPDATE pagetext SET text = ? WHERE id = ?`, "I like [[Green  Pears]]", textId); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path []int
+		ok   bool
+	}{
+		{"home", []int{HomePageID}, true},
+		{"a page on its own", []int{apples}, true},
+		{"linked", []int{HomePageID, fruit, apples}, true},
+		{"referenced inline", []int{HomePageID, fruit, apples, pears}, true},
+		{"reversed", []int{HomePageID, apples, fruit}, false},
+		{"skipping a page", []int{HomePageID, apples}, false},
+		{"missing page", []int{HomePageID, fruit, 9999}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			titles, ok, err := getPathTitles(context.Background(), test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != test.ok {
+				t.Fatalf("ok = %v, want %v", ok, test.ok)
+			}
+			if ok && len(titles) != len(test.path) {
+				t.Errorf("%d titles for a path of %d pages", len(titles), len(test.path))
+			}
+		})
+	}
+}
+
+// Breadcrumbs for paths of linked pages, with titles cached and without
+func BenchmarkGetPathTitles(b *testing.B) {
+	openTestDB(b)
+	userId := createTestUser(b, "bench")
+	chain := []int{HomePageID}
+	for i := 1; i < 64; i++ {
+		pageId := createTestPage(b, "page "+strconv.Itoa(i))
+		createTestLink(b, chain[i-1], userId, pageId)
+		chain = append(chain, pageId)
+	}
+	ctx := context.Background()
+
+	for _, depth := range []int{4, 16, 64} {
+		path := chain[:depth]
+		for _, cached := range []bool{true, false} {
+			name := strconv.Itoa(depth) + "/uncached"
+			if cached {
+				name = strconv.Itoa(depth) + "/cached"
+			}
+			b.Run(name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if !cached {
+						titleCache = newTitleLRU(maxTitleCacheEntries)
+					}
+					if _, ok, err := getPathTitles(ctx, path); err != nil || !ok {
+						b.Fatalf("ok = %v, err = %v", ok, err)
+					}
+				}
+			})
+		}
+	}
+}
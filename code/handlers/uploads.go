@@ -0,0 +1,526 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"postpath/database"
+	"postpath/storage"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/draw"
+)
+
+const (
+	// Largest decoded image, which guards against decompression bombs
+	maxImagePixels = 40_000_000
+	// Most frames an animated GIF may have. Its frames share maxImagePixels.
+	maxGIFFrames = 500
+	// Width thumbnails are scaled down to
+	thumbnailWidth = 480
+	jpegQuality    = 90
+)
+
+var (
+	errUploadsDisabled  = errors.New("image uploads are disabled")
+	errUnsupportedImage = errors.New("only JPEG, PNG and GIF images are supported")
+	errImageTooLarge    = errors.New("image dimensions are too large")
+	errTooManyFrames    = fmt.Errorf("animated images are limited to %d frames", maxGIFFrames)
+)
+
+// Content types uploads are served with, by stored file extension
+var uploadTypes = map[string]string{
+	".jpg": "image/jpeg",
+	".png": "image/png",
+	".gif": "image/gif",
+}
+
+var uploads storage.Storage
+
+type Attachment struct {
+	ID       int
+	Key      string
+	ThumbKey string
+	Width    int
+	Height   int
+}
+
+func (a Attachment) URL() string {
+	return "/uploads/" + a.Key
+}
+
+func (a Attachment) ThumbURL() string {
+	return "/uploads/" + a.ThumbKey
+}
+
+// An upload that has been validated and re-encoded without its metadata
+type processedImage struct {
+	ext       string
+	data      []byte
+	thumbnail []byte
+	width     int
+	height    int
+}
+
+func SetupStorage(s storage.Storage) {
+	uploads = s
+}
+
+// Serves uploaded images
+func UploadHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	contentType, ok := uploadTypes[filepath.Ext(key)]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := uploads.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to read upload", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Keys are random and never reused, so uploads can be cached forever
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if _, err := io.Copy(w, f); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to serve upload", "key", key, "err", err)
+	}
+}
+
+// Helper Functions
+
+// Parses a post form, which is multipart when it carries an image
+func parsePostForm(w http.ResponseWriter, r *http.Request) error {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return r.ParseForm()
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize()+(1<<20))
+	return r.ParseMultipartForm(maxUploadSize())
+}
+
+// Returns the image uploaded with a post, or nil if there is none
+func readImageUpload(r *http.Request) (*processedImage, error) {
+	file, _, err := r.FormFile("image")
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if !settings.Features.Uploads {
+		return nil, errUploadsDisabled
+	}
+	return processImage(file)
+}
+
+// Checks an upload really is a supported image, then re-encodes it, which
+// drops EXIF and any other embedded metadata, and renders a thumbnail
+func processImage(file multipart.File) (*processedImage, error) {
+	data, err := io.ReadAll(io.LimitReader(file, maxUploadSize()+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxUploadSize() {
+		return nil, fmt.Errorf("images are limited to %d MB", settings.MaxUploadMB)
+	}
+
+	// Trust the bytes, not the file name or the client's content type
+	var ext string
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		ext = ".jpg"
+	case "image/png":
+		ext = ".png"
+	case "image/gif":
+		ext = ".gif"
+	default:
+		return nil, errUnsupportedImage
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, errImageTooLarge
+	}
+
+	var img image.Image
+	var buf bytes.Buffer
+	width, height := config.Width, config.Height
+	switch ext {
+	case ".gif":
+		// Every frame is decoded, so check them all before decoding any
+		frames, pixels, ok := gifFrames(data)
+		if !ok {
+			return nil, errUnsupportedImage
+		}
+		if frames > maxGIFFrames {
+			return nil, errTooManyFrames
+		}
+		if pixels > maxImagePixels {
+			return nil, errImageTooLarge
+		}
+		// Keep animation but drop comment and application extensions
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, errUnsupportedImage
+		}
+		if err := gif.EncodeAll(&buf, anim); err != nil {
+			return nil, err
+		}
+		img = anim.Image[0]
+		width, height = anim.Config.Width, anim.Config.Height
+	case ".png":
+		if img, err = png.Decode(bytes.NewReader(data)); err != nil {
+			return nil, errUnsupportedImage
+		}
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+	default:
+		if img, err = jpeg.Decode(bytes.NewReader(data)); err != nil {
+			return nil, errUnsupportedImage
+		}
+		// The orientation lives in the EXIF being dropped, so apply it first
+		img = applyOrientation(img, jpegOrientation(data))
+		width, height = img.Bounds().Dx(), img.Bounds().Dy()
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, err
+		}
+	}
+
+	processed := &processedImage{
+		ext:    ext,
+		data:   buf.Bytes(),
+		width:  width,
+		height: height,
+	}
+	if img.Bounds().Dx() > thumbnailWidth {
+		if processed.thumbnail, err = renderThumbnail(img, ext); err != nil {
+			return nil, err
+		}
+	}
+	return processed, nil
+}
+
+// Scales an image down to the thumbnail width. Thumbnails of PNGs stay PNG
+// to keep transparency; everything else becomes a JPEG.
+func renderThumbnail(img image.Image, ext string) ([]byte, error) {
+	bounds := img.Bounds()
+	height := bounds.Dy() * thumbnailWidth / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbnailWidth, height))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	var err error
+	if ext == ".png" {
+		err = png.Encode(&buf, thumb)
+	} else {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: jpegQuality})
+	}
+	return buf.Bytes(), err
+}
+
+// Stores a processed image and attaches it to a text
+func saveAttachment(ctx context.Context, textId int, userId int, img *processedImage) (Attachment, error) {
+	id, err := randomKey()
+	if err != nil {
+		return Attachment{}, err
+	}
+	attachment := Attachment{
+		Key:      id + img.ext,
+		ThumbKey: id + img.ext,
+		Width:    img.width,
+		Height:   img.height,
+	}
+
+	if err := uploads.Put(ctx, attachment.Key, bytes.NewReader(img.data)); err != nil {
+		return Attachment{}, err
+	}
+	if img.thumbnail != nil {
+		thumbExt := ".jpg"
+		if img.ext == ".png" {
+			thumbExt = ".png"
+		}
+		attachment.ThumbKey = id + "_thumb" + thumbExt
+		if err := uploads.Put(ctx, attachment.ThumbKey, bytes.NewReader(img.thumbnail)); err != nil {
+			return Attachment{}, err
+		}
+	}
+
+	row, cancel := database.QueryRowWithTimeout(ctx, `
+		INSERT INTO attachments (text_id, user_id, storage_key, thumb_key, width, height, size)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, textId, userId, attachment.Key, attachment.ThumbKey, attachment.Width, attachment.Height, len(img.data))
+	defer cancel()
+	err = row.Scan(&attachment.ID)
+	return attachment, err
+}
+
+// Returns the attachments of every text on a page, keyed by text id
+func getPageAttachments(ctx context.Context, pageId int) map[int][]Attachment {
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT attachments.text_id, attachments.id, attachments.storage_key, attachments.thumb_key, attachments.width, attachments.height
+		FROM attachments
+		INNER JOIN pagetext ON pagetext.id = attachments.text_id
+		WHERE pagetext.page_id = ?
+		ORDER BY attachments.id
+	`, pageId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query attachments", "page_id", pageId, "err", err)
+		return nil
+	}
+	defer cancel()
+	defer rows.Close()
+
+	attachments := map[int][]Attachment{}
+	for rows.Next() {
+		var textId int
+		var a Attachment
+		if err := rows.Scan(&textId, &a.ID, &a.Key, &a.ThumbKey, &a.Width, &a.Height); err != nil {
+			continue
+		}
+		attachments[textId] = append(attachments[textId], a)
+	}
+	return attachments
+}
+
+func getTextAttachments(ctx context.Context, textId int) []Attachment {
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT id, storage_key, thumb_key, width, height
+		FROM attachments
+		WHERE text_id = ?
+		ORDER BY id
+	`, textId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query attachments", "text_id", textId, "err", err)
+		return nil
+	}
+	defer cancel()
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.Key, &a.ThumbKey, &a.Width, &a.Height); err != nil {
+			continue
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments
+}
+
+// Returns the storage keys of the attachment files of a user's text and
+// every reply under it. Deleting the text cascades to its replies and removes
+// their attachment rows, so the keys are read beforehand.
+func attachmentKeys(ctx context.Context, pageId int, textId int, userId int) []string {
+	keys, err := database.SubtreeAttachmentKeys(ctx, pageId, textId, userId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query attachments", "text_id", textId, "err", err)
+	}
+	return keys
+}
+
+// Removes the stored files of a deleted text's attachments
+func deleteUploads(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := uploads.Delete(ctx, key); err != nil {
+			slog.ErrorContext(ctx, "Failed to delete upload", "key", key, "err", err)
+		}
+	}
+}
+
+// Largest image accepted for upload, in bytes
+func maxUploadSize() int64 {
+	return int64(settings.MaxUploadMB) << 20
+}
+
+func randomKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Counts the frames of a GIF and the pixels they decode to without decoding
+// them. ok is false when the block structure is malformed.
+func gifFrames(data []byte) (frames int, pixels int, ok bool) {
+	// Header and logical screen descriptor
+	if len(data) < 13 {
+		return 0, 0, false
+	}
+	i := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&0x07 + 1)
+	}
+
+	// Skips a run of data sub-blocks, ending at the zero length terminator
+	skipSubBlocks := func() bool {
+		for i < len(data) {
+			size := int(data[i])
+			i++
+			if size == 0 {
+				return true
+			}
+			i += size
+		}
+		return false
+	}
+
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // Extension: introducer, label, sub-blocks
+			i += 2
+			if !skipSubBlocks() {
+				return 0, 0, false
+			}
+		case 0x2C: // Image descriptor, then its color table and image data
+			if i+10 > len(data) {
+				return 0, 0, false
+			}
+			width := int(data[i+5]) | int(data[i+6])<<8
+			height := int(data[i+7]) | int(data[i+8])<<8
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			// LZW minimum code size
+			i++
+			if !skipSubBlocks() {
+				return 0, 0, false
+			}
+			frames++
+			pixels += width * height
+		case 0x3B: // Trailer
+			return frames, pixels, true
+		default:
+			return 0, 0, false
+		}
+	}
+	// Decoders accept a missing trailer
+	return frames, pixels, frames > 0
+}
+
+// Reads the EXIF orientation of a JPEG, defaulting to 1 (upright)
+func jpegOrientation(data []byte) int {
+	// Walk the JPEG markers looking for the APP1 Exif segment
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// Finds the orientation tag in the first IFD of EXIF's TIFF structure
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	u16 := func(b []byte) int { return int(b[1])<<8 | int(b[0]) }
+	u32 := func(b []byte) int { return int(b[3])<<24 | int(b[2])<<16 | int(b[1])<<8 | int(b[0]) }
+	if string(tiff[:2]) == "MM" {
+		u16 = func(b []byte) int { return int(b[0])<<8 | int(b[1]) }
+		u32 = func(b []byte) int { return int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3]) }
+	} else if string(tiff[:2]) != "II" {
+		return 1
+	}
+
+	ifd := u32(tiff[4:8])
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := u16(tiff[ifd : ifd+2])
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if u16(tiff[entry:entry+2]) == 0x0112 {
+			if orientation := u16(tiff[entry+8 : entry+10]); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// Rotates and flips an image so an EXIF orientation becomes upright
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	// Orientations 5 to 8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			out.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return out
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"strconv"
+	"testing"
+)
+
+// An upload held in memory, standing in for a multipart file
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error { return nil }
+
+// Encodes an animated GIF of identical frames
+func encodeGIF(tb testing.TB, frames int, width int, height int) []byte {
+	tb.Helper()
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, width, height), palette))
+		anim.Delay = append(anim.Delay, 0)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Builds a GIF whose frames claim the given size but hold almost no image
+// data, as a decompression bomb would
+func claimedGIF(frames int, width int, height int) []byte {
+	size := func(w, h int) []byte {
+		return binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(nil, uint16(w)), uint16(h))
+	}
+	data := append([]byte("GIF89a"), size(width, height)...)
+	data = append(data, 0x80, 0, 0, 0, 0, 0, 0xFF, 0xFF, 0xFF) // two color global table
+	for i := 0; i < frames; i++ {
+		data = append(data, 0x2C, 0, 0, 0, 0)
+		data = append(data, size(width, height)...)
+		data = append(data, 0, 2, 2, 0x4C, 0x01, 0) // no local table, LZW size 2, one sub-block
+	}
+	return append(data, 0x3B)
+}
+
+func TestGIFFrames(t *testing.T) {
+	valid := encodeGIF(t, 3, 20, 10)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		frames int
+		pixels int
+		ok     bool
+	}{
+		{"animation", valid, 3, 600, true},
+		{"missing trailer", valid[:len(valid)-1], 3, 600, true},
+		{"claimed sizes", claimedGIF(4, 1000, 1000), 4, 4_000_000, true},
+		{"header only", valid[:13], 0, 0, false},
+		{"truncated header", valid[:8], 0, 0, false},
+		{"truncated frame", valid[:len(valid)-5], 0, 0, false},
+		{"unknown block", append(append([]byte{}, valid[:len(valid)-1]...), 0x99), 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frames, pixels, ok := gifFrames(test.data)
+			if frames != test.frames || pixels != test.pixels || ok != test.ok {
+				t.Errorf("gifFrames = %d, %d, %v, want %d, %d, %v", frames, pixels, ok, test.frames, test.pixels, test.ok)
+			}
+		})
+	}
+}
+
+func TestProcessImageGIFLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"too many frames", encodeGIF(t, maxGIFFrames+1, 1, 1), errTooManyFrames},
+		{"frames over the pixel limit", claimedGIF(3, 4000, 4000), errImageTooLarge},
+		{"screen over the pixel limit", claimedGIF(1, 65535, 65535), errImageTooLarge},
+		{"truncated", encodeGIF(t, 2, 20, 10)[:40], errUnsupportedImage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := processImage(memoryFile{bytes.NewReader(test.data)}); !errors.Is(err, test.err) {
+				t.Errorf("processImage: %v, want %v", err, test.err)
+			}
+		})
+	}
+
+	processed, err := processImage(memoryFile{bytes.NewReader(encodeGIF(t, maxGIFFrames, 2, 2))})
+	if err != nil {
+		t.Fatalf("animation at the frame limit: %v", err)
+	}
+	if processed.width != 2 || processed.height != 2 {
+		t.Errorf("processed size %dx%d, want 2x2", processed.width, processed.height)
+	}
+}
+
+// Builds EXIF's TIFF structure holding one orientation entry
+func exifTIFF(order binary.AppendByteOrder, orientation int) []byte {
+	tiff := []byte("II")
+	if order == binary.BigEndian {
+		tiff = []byte("MM")
+	}
+	tiff = order.AppendUint16(tiff, 42)
+	tiff = order.AppendUint32(tiff, 8) // first IFD
+	tiff = order.AppendUint16(tiff, 1) // entries
+	tiff = order.AppendUint16(tiff, 0x0112)
+	tiff = order.AppendUint16(tiff, 3) // SHORT
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, uint16(orientation))
+	tiff = order.AppendUint16(tiff, 0)
+	return order.AppendUint32(tiff, 0) // no next IFD
+}
+
+// Inserts an APP1 Exif segment holding tiff after a JPEG's start marker
+func withEXIF(jpg []byte, tiff []byte) []byte {
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(segment)+2))
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, app1...)
+	out = append(out, segment...)
+	return append(out, jpg[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		for _, order := range []binary.AppendByteOrder{binary.LittleEndian, binary.BigEndian} {
+			t.Run(strconv.Itoa(orientation)+"/"+order.String(), func(t *testing.T) {
+				if got := jpegOrientation(withEXIF(plain, exifTIFF(order, orientation))); got != orientation {
+					t.Errorf("jpegOrientation = %d, want %d", got, orientation)
+				}
+			})
+		}
+	}
+
+	valid := exifTIFF(binary.LittleEndian, 6)
+	malformed := []struct {
+		name string
+		data []byte
+	}{
+		{"no exif", plain},
+		{"out of range", withEXIF(plain, exifTIFF(binary.LittleEndian, 9))},
+		{"unknown byte order", withEXIF(plain, append([]byte("XX"), valid[2:]...))},
+		{"truncated tiff", withEXIF(plain, valid[:6])},
+		{"truncated entry", withEXIF(plain, valid[:16])},
+		{"ifd past the end", withEXIF(plain, append(append([]byte{}, valid[:4]...), 0xFF, 0, 0, 0))},
+		{"segment past the end", withEXIF(plain, valid)[:20]},
+		{"not a jpeg", []byte("GIF89a")},
+	}
+	for _, test := range malformed {
+		t.Run(test.name, func(t *testing.T) {
+			if got := jpegOrientation(test.data); got != 1 {
+				t.Errorf("jpegOrientation = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// A 3x2 image with its stored top-left pixel marked
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	marked := color.RGBA{R: 255, A: 255}
+	img.Set(0, 0, marked)
+
+	// Where the stored top-left pixel belongs once upright
+	tests := []struct {
+		orientation int
+		width       int
+		height      int
+		x, y        int
+	}{
+		{1, 3, 2, 0, 0},
+		{2, 3, 2, 2, 0},
+		{3, 3, 2, 2, 1},
+		{4, 3, 2, 0, 1},
+		{5, 2, 3, 0, 0},
+		{6, 2, 3, 1, 0},
+		{7, 2, 3, 1, 2},
+		{8, 2, 3, 0, 2},
+	}
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.orientation), func(t *testing.T) {
+			out := applyOrientation(img, test.orientation)
+			if out.Bounds().Dx() != test.width || out.Bounds().Dy() != test.height {
+				t.Fatalf("size %dx%d, want %dx%d", out.Bounds().Dx(), out.Bounds().Dy(), test.width, test.height)
+			}
+			if got := color.RGBAModel.Convert(out.At(test.x, test.y)); got != marked {
+				t.Errorf("pixel at %d,%d is %v, want the marked pixel", test.x, test.y, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"postpath/database"
+	"strconv"
+	"time"
+)
+
+// Deepest level of linked subpages a watch can follow
+const maxWatchDepth = 3
+
+// How long a recorded page visit stays fresh enough to skip rewriting
+const visitInterval = time.Minute
+
+type WatchedPage struct {
+	PageID          int
+	Title           string
+	Path            string
+	Depth           int
+	Unread          int
+	LastActivityStr string
+}
+
+// Watches the last page of a path, optionally following its linked subpages
+func WatchHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	path := getPath(r)
+	if path == nil || path[len(path)-1] == ProfilePageID {
+		htmxError(w, "You cannot watch this page.", http.StatusBadRequest)
+		return
+	}
+	pageId := path[len(path)-1]
+
+	depth, err := strconv.Atoi(r.FormValue("depth"))
+	if err != nil || depth < 0 || depth > maxWatchDepth {
+		depth = 0
+	}
+
+	_, cancel, err := database.ExecWithTimeout(r.Context(), `
+		INSERT INTO page_watches (user_id, page_id, path, depth, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, page_id) DO UPDATE SET path = excluded.path, depth = excluded.depth
+	`, userId, pageId, joinPath(path), depth, time.Now())
+	if err != nil {
+		htmxError(w, "Failed to watch page", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+
+	render(w, r, "watchbutton", watchData(r.Context(), userId, path))
+}
+
+func UnwatchHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId := GetUserFromContext(r)
+
+	path := getPath(r)
+	if path == nil {
+		htmxError(w, "PageID missing", http.StatusNotFound)
+		return
+	}
+
+	_, cancel, err := database.ExecWithTimeout(r.Context(), `DELETE FROM page_watches WHERE user_id = ? AND page_id = ?`, userId, path[len(path)-1])
+	if err != nil {
+		htmxError(w, "Failed to unwatch page", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+
+	render(w, r, "watchbutton", watchData(r.Context(), userId, path))
+}
+
+// Lists watched pages with posts from other users since the last visit
+func WatchedHandler(w http.ResponseWriter, r *http.Request) {
+	user, userId := GetUserFromContext(r)
+
+	data := map[string]any{
+		"Username": user,
+		"LoggedIn": user != "",
+		"Unread":   getUnreadWatchedPages(r.Context(), userId),
+		"Watches":  getWatches(r.Context(), userId),
+	}
+	render(w, r, "watched", data)
+}
+
+// Helper Functions
+
+// Returns the data the watch button needs for a page
+func watchData(ctx context.Context, userId int, path []int) map[string]any {
+	pageId := path[len(path)-1]
+
+	var depth int
+	row, cancel := database.QueryRowWithTimeout(ctx, `SELECT depth FROM page_watches WHERE user_id = ? AND page_id = ?`, userId, pageId)
+	defer cancel()
+	watching := row.Scan(&depth) == nil
+
+	return map[string]any{
+		"PageID":     pageId,
+		"WatchPath":  joinPath(path),
+		"Watching":   watching,
+		"WatchDepth": depth,
+	}
+}
+
+// Remembers when a user last saw a page so the watched view only shows
+// newer posts. A visit within visitInterval of the last recorded one is
+// skipped so browsing does not write on every page view, unless another
+// user has posted on the page since, which this visit has now seen.
+func recordPageVisit(ctx context.Context, userId int, pageId int) {
+	if userId <= 0 {
+		return
+	}
+
+	now := time.Now()
+	var recent int
+	row, cancel := database.QueryRowWithTimeout(ctx, `
+		SELECT 1 FROM page_visits
+		WHERE user_id = ? AND page_id = ? AND last_seen_at > ?
+		AND NOT EXISTS (
+			SELECT 1 FROM pagetext
+			WHERE pagetext.page_id = page_visits.page_id
+			AND pagetext.user_id != page_visits.user_id
+			AND pagetext.created_at > page_visits.last_seen_at
+		)
+	`, userId, pageId, now.Add(-visitInterval))
+	defer cancel()
+	if row.Scan(&recent) == nil {
+		return
+	}
+
+	_, cancelExec, err := database.ExecWithTimeout(ctx, `
+		INSERT INTO page_visits (user_id, page_id, last_seen_at) VALUES (?, ?, ?)
+		ON CONFLICT(user_id, page_id) DO UPDATE SET last_seen_at = excluded.last_seen_at
+	`, userId, pageId, now)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record page visit", "page_id", pageId, "err", err)
+		return
+	}
+	cancelExec()
+}
+
+// Returns the watched pages with posts the user has not seen yet, most
+// recently active first
+func getUnreadWatchedPages(ctx context.Context, userId int) []WatchedPage {
+	unread, err := database.UnreadWatchedPages(ctx, userId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query watched pages", "user_id", userId, "err", err)
+		return nil
+	}
+
+	var pages []WatchedPage
+	for _, page := range unread {
+		watched := WatchedPage{PageID: page.PageID, Title: page.Title, Path: page.Path, Unread: page.Unread}
+		if !page.LastActivity.IsZero() {
+			watched.LastActivityStr = page.LastActivity.Format("2006-01-02 15:04")
+		}
+		pages = append(pages, watched)
+	}
+	return pages
+}
+
+func getWatches(ctx context.Context, userId int) []WatchedPage {
+	rows, cancel, err := database.QueryWithTimeout(ctx, `
+		SELECT pages.id, pages.title, page_watches.path, page_watches.depth
+		FROM page_watches
+		INNER JOIN pages ON pages.id = page_watches.page_id
+		WHERE page_watches.user_id = ?
+		ORDER BY pages.title
+	`, userId)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to query watches", "user_id", userId, "err", err)
+		return nil
+	}
+	defer cancel()
+	defer rows.Close()
+
+	var pages []WatchedPage
+	for rows.Next() {
+		var page WatchedPage
+		if err := rows.Scan(&page.PageID, &page.Title, &page.Path, &page.Depth); err != nil {
+			continue
+		}
+		pages = append(pages, page)
+	}
+	return pages
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"context"
+	"postpath/database"
+	"testing"
+	"time"
+)
+
+// A page view shortly after the last recorded one still marks posts made in
+// between as seen
+func TestRecordPageVisit(t *testing.T) {
+	openTestDB(t)
+	watcher := createTestUser(t, "watcher")
+	poster := createTestUser(t, "poster")
+	pageId := createTestPage(t, "watched")
+	_, err := database.DB().Exec(
+		`INSERT INTO page_watches (user_id, page_id, path, depth, created_at) VALUES (?, ?, ?, 0, ?)`,
+		watcher, pageId, joinPath([]int{HomePageID, pageId}), time.Now().Add(-time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	recordPageVisit(ctx, watcher, pageId)
+	createTestText(t, pageId, poster, 0)
+	if unread := getUnreadWatchedPages(ctx, watcher); len(unread) != 1 || unread[0].Unread != 1 {
+		t.Fatalf("unread pages %+v after a new post, want one post on one page", unread)
+	}
+
+	recordPageVisit(ctx, watcher, pageId)
+	if unread := getUnreadWatchedPages(ctx, watcher); len(unread) != 0 {
+		t.Errorf("unread pages %+v after viewing the page, want none", unread)
+	}
+}
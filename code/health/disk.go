@@ -0,0 +1,30 @@
+package health
+
+import (
+	"context"
+	"fmt"
+)
+
+// Fails when the filesystem holding dir has less than minFreeMB megabytes
+// free, since SQLite needs room for its journal before it can write
+func DiskSpace(dir string, minFreeMB uint64) Check {
+	return Check{
+		Name: "disk",
+		Run: func(ctx context.Context) (map[string]any, error) {
+			free, ok, err := freeBytes(dir)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return map[string]any{"free_mb": "unknown"}, nil
+			}
+
+			freeMB := free >> 20
+			detail := map[string]any{"free_mb": freeMB, "min_free_mb": minFreeMB}
+			if freeMB < minFreeMB {
+				return detail, fmt.Errorf("only %d MB free", freeMB)
+			}
+			return detail, nil
+		},
+	}
+}
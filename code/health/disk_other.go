@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package health
+
+// Free space is not checked on platforms without statfs
+func freeBytes(dir string) (uint64, bool, error) {
+	return 0, false, nil
+}
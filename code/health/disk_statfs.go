@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package health
+
+import "syscall"
+
+// Returns the bytes available to unprivileged users on dir's filesystem
+func freeBytes(dir string) (uint64, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, false, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), true, nil
+}
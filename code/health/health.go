@@ -0,0 +1,74 @@
+// Package health serves the liveness and readiness endpoints that docker
+// and the proxy use to decide whether to send the server traffic.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Time all readiness checks together may take
+const checkTimeout = 2 * time.Second
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// A named readiness check. Run returns optional detail to report alongside
+// the result, and an error when the server should not receive traffic.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) (map[string]any, error)
+}
+
+type result struct {
+	Status string         `json:"status"`
+	Error  string         `json:"error,omitempty"`
+	Detail map[string]any `json:"detail,omitempty"`
+}
+
+type report struct {
+	Status string            `json:"status"`
+	Checks map[string]result `json:"checks,omitempty"`
+}
+
+// Reports that the process is up and serving requests
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, http.StatusOK, report{Status: StatusOK})
+}
+
+// Runs every check and reports 503 if any of them fails
+func ReadyHandler(checks ...Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		defer cancel()
+
+		rep := report{Status: StatusOK, Checks: map[string]result{}}
+		for _, check := range checks {
+			detail, err := check.Run(ctx)
+			res := result{Status: StatusOK, Detail: detail}
+			if err != nil {
+				res.Status = StatusUnavailable
+				res.Error = err.Error()
+				rep.Status = StatusUnavailable
+			}
+			rep.Checks[check.Name] = res
+		}
+
+		status := http.StatusOK
+		if rep.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+		writeReport(w, status, rep)
+	})
+}
+
+func writeReport(w http.ResponseWriter, status int, rep report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,142 @@
+// Package logging sets up structured logging and tags each request's log
+// lines with a request ID.
+//
+// Log lines carry IDs, never content: post, reply and description text,
+// passwords, emails and session cookies must not be logged.
+// Request logs record the path without its query string for the same reason.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"postpath/response"
+	"postpath/tracing"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Header a request ID is read from, when a proxy set one, and echoed in
+const RequestIDHeader = "X-Request-ID"
+
+// Proxy-supplied IDs are only trusted when they cannot forge log fields
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+type contextKey struct{}
+
+// Per-request details filled in as the request moves through the handlers
+type requestInfo struct {
+	id     string
+	userID int
+}
+
+// Installs the default logger. format is "text" or "json"; level is one of
+// "debug", "info", "warn" or "error".
+func Setup(w io.Writer, format string, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text", "":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+// Logs msg as an error and exits, for failures the server cannot start with
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Assigns each request an ID and logs it once it has been served
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		info := &requestInfo{id: id}
+		w.Header().Set(RequestIDHeader, id)
+
+		rw := response.NewRecorder(w)
+		ctx := context.WithValue(r.Context(), contextKey{}, info)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if rw.Status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.LogAttrs(ctx, level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rw.Status),
+			slog.Int("bytes", rw.Bytes),
+			slog.Duration("latency", time.Since(start)),
+			slog.Int("user_id", info.userID),
+		)
+	})
+}
+
+// Records the signed-in user so the request log can name them
+func SetUserID(ctx context.Context, userID int) {
+	if info, ok := ctx.Value(contextKey{}).(*requestInfo); ok {
+		info.userID = userID
+	}
+}
+
+// Returns the ID of the request being served, or "" outside a request
+func RequestID(ctx context.Context) string {
+	if info, ok := ctx.Value(contextKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// Adds the request and trace IDs to lines logged with a request's context
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if id := tracing.TraceID(ctx); id != "" {
+		record.AddAttrs(slog.String("trace_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
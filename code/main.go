@@ -1,36 +1,98 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"postpath/config"
 	"postpath/database"
 	"postpath/handlers"
+	"postpath/health"
+	"postpath/logging"
+	"postpath/metrics"
+	"postpath/storage"
+	"postpath/tracing"
+	"syscall"
 
 	"github.com/gorilla/mux"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
+	// Docker stops containers with SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg, err := config.Load()
+	if err != nil {
+		logging.Fatal("Failed to load config", "err", err)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck(cfg.ListenAddr))
+	}
+	if err := logging.Setup(os.Stderr, cfg.LogFormat, cfg.LogLevel); err != nil {
+		logging.Fatal("Failed to set up logging", "err", err)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		os.Exit(runBackup(ctx, cfg, os.Args[2:]))
+	}
+	shutdownTracing, err := tracing.Setup(ctx, cfg.TraceExporter, cfg.TraceEndpoint, cfg.TraceSampleRatio)
+	if err != nil {
+		logging.Fatal("Failed to set up tracing", "err", err)
+	}
+
 	// Generate a proper key for production
 	key := make([]byte, 32)
 	if _, err := rand.Read(key); err != nil {
-		log.Fatal(err)
+		logging.Fatal("Failed to generate session key", "err", err)
 	}
 
-	handlers.SetupHelpers("templates/*.gohtml", key)
+	handlers.SetupHelpers("templates/*.gohtml", key, cfg)
 
-	database.InitDB("./local/postpath.db")
-	defer database.DB().Close()
+	database.InitDB(cfg.DBPath, cfg.DBTimeout.Duration)
 
-	handlers.HandlerInit()
+	uploads, err := storage.NewLocal(cfg.UploadDir)
+	if err != nil {
+		logging.Fatal("Failed to open upload storage", "err", err)
+	}
+	handlers.SetupStorage(uploads)
 
+	handlers.HandlerInit()
+	if cfg.BackupInterval.Duration > 0 {
+		database.StartBackups(ctx, cfg.BackupDir, cfg.BackupInterval.Duration, cfg.BackupKeep)
+	}
+	if cfg.Features.LinkPreviews {
+		handlers.StartLinkPreviews(ctx)
+	}
 	mux := mux.NewRouter()
+	mux.Use(metrics.Middleware, tracing.RouteMiddleware)
+
+	// Health checks sit outside AuthMiddleware so docker can reach them.
+	// PostgreSQL keeps its data elsewhere, leaving uploads to fill the disk.
+	diskDir := filepath.Dir(cfg.DBPath)
+	if database.IsPostgres(cfg.DBPath) {
+		diskDir = cfg.UploadDir
+	}
+	mux.HandleFunc("/healthz", health.LiveHandler).Methods("GET")
+	mux.Handle("/readyz", health.ReadyHandler(
+		health.Check{Name: "database", Run: func(ctx context.Context) (map[string]any, error) {
+			return nil, database.DB().PingContext(ctx)
+		}},
+		health.Check{Name: "schema", Run: func(ctx context.Context) (map[string]any, error) {
+			return nil, database.CheckSchema(ctx)
+		}},
+		health.Check{Name: "templates", Run: handlers.CheckTemplates},
+		health.DiskSpace(diskDir, uint64(cfg.MinFreeDiskMB)),
+	)).Methods("GET")
 
 	// Static files
 	fs := http.FileServer(http.Dir("static"))
 	mux.PathPrefix("/styles/").Handler(http.StripPrefix("/styles/", fs))
 	mux.PathPrefix("/images/").Handler(http.StripPrefix("/images/", fs))
+	mux.HandleFunc("/uploads/{key}", handlers.UploadHandler).Methods("GET")
 
 	// Protected routes
 	protected := mux.NewRoute().Subrouter()
@@ -43,17 +105,112 @@ func main() {
 	protected.HandleFunc("/profile/{path:.*}", handlers.ProfilePageHandler).Methods("GET")
 	protected.HandleFunc("/home", handlers.PageHandler).Methods("GET")
 	protected.HandleFunc("/page/{path:.*}", handlers.PageHandler).Methods("GET")
+	protected.HandleFunc("/link/{path:.*}", handlers.LinkHandler).Methods("GET")
+	protected.HandleFunc("/events/{pageId:[0-9]+}", handlers.PageEventsHandler).Methods("GET")
 	protected.HandleFunc("/addText/{path:.*}", handlers.AddTextHandler).Methods("POST")
 	protected.HandleFunc("/editText/{pageId:[0-9]+}/{textId:[0-9]+}", handlers.EditTextHandler).Methods("GET")
 	protected.HandleFunc("/editText/{pageId:[0-9]+}/{textId:[0-9]+}/cancel", handlers.EditTextCancelHandler).Methods("GET")
 	protected.HandleFunc("/editText/{pageId:[0-9]+}/{textId:[0-9]+}", handlers.UpdateTextHandler).Methods("PUT")
 	protected.HandleFunc("/editText/{pageId:[0-9]+}/{textId:[0-9]+}", handlers.DeleteTextHandler).Methods("DELETE")
+	protected.HandleFunc("/pinText/{pageId:[0-9]+}/{textId:[0-9]+}", handlers.PinTextHandler).Methods("PUT")
+	protected.HandleFunc("/editDescription/{pageId:[0-9]+}", handlers.EditDescriptionHandler).Methods("GET")
+	protected.HandleFunc("/editDescription/{pageId:[0-9]+}/cancel", handlers.EditDescriptionCancelHandler).Methods("GET")
+	protected.HandleFunc("/editDescription/{pageId:[0-9]+}", handlers.UpdateDescriptionHandler).Methods("PUT")
+	protected.HandleFunc("/merge", handlers.MergeHandler).Methods("GET", "POST")
+	protected.HandleFunc("/feed", handlers.FeedHandler).Methods("GET")
+	protected.HandleFunc("/feed/more", handlers.FeedPageHandler).Methods("GET")
+	protected.HandleFunc("/follow/{userId:[0-9]+}", handlers.FollowHandler).Methods("POST")
+	protected.HandleFunc("/follow/{userId:[0-9]+}", handlers.UnfollowHandler).Methods("DELETE")
+	protected.HandleFunc("/openProfile", handlers.OpenProfileHandler).Methods("POST")
+	protected.HandleFunc("/openProfile", handlers.CloseProfileHandler).Methods("DELETE")
+	protected.HandleFunc("/watched", handlers.WatchedHandler).Methods("GET")
+	protected.HandleFunc("/watch/{path:[0-9/]+}", handlers.WatchHandler).Methods("POST")
+	protected.HandleFunc("/watch/{path:[0-9/]+}", handlers.UnwatchHandler).Methods("DELETE")
+	protected.HandleFunc("/reply/{textId:[0-9]+}", handlers.ReplyEditorHandler).Methods("GET")
+	protected.HandleFunc("/reply/{textId:[0-9]+}", handlers.ReplyHandler).Methods("POST")
+	protected.HandleFunc("/preview/{textId:[0-9]+}", handlers.LinkPreviewHandler).Methods("GET")
+	protected.HandleFunc("/react/{textId:[0-9]+}", handlers.ReactHandler).Methods("POST")
+	protected.HandleFunc("/save/{textId:[0-9]+}", handlers.SaveFormHandler).Methods("GET")
+	protected.HandleFunc("/save/{textId:[0-9]+}/cancel", handlers.SaveFormCancelHandler).Methods("GET")
+	protected.HandleFunc("/save/{textId:[0-9]+}", handlers.SaveTextHandler).Methods("POST")
+	protected.HandleFunc("/saved", handlers.SavedHandler).Methods("GET")
+	protected.HandleFunc("/saved/{collectionId:[0-9]+}", handlers.CollectionHandler).Methods("GET")
+	protected.HandleFunc("/saved/{collectionId:[0-9]+}", handlers.DeleteCollectionHandler).Methods("DELETE")
+	protected.HandleFunc("/saved/{collectionId:[0-9]+}/{textId:[0-9]+}", handlers.RemoveSavedTextHandler).Methods("DELETE")
+	protected.HandleFunc("/api/collections", handlers.CollectionsAPIHandler).Methods("GET")
+	protected.HandleFunc("/notifications", handlers.NotificationsHandler).Methods("GET")
+	protected.HandleFunc("/notifications/count", handlers.NotificationBellHandler).Methods("GET")
+	protected.HandleFunc("/notifications/read", handlers.MarkAllNotificationsReadHandler).Methods("POST")
+	protected.HandleFunc("/notifications/{notificationId:[0-9]+}/read", handlers.MarkNotificationReadHandler).Methods("POST")
 
 	// Handle 404
-	mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	mux.NotFoundHandler = metrics.NotFound(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusFound)
-	})
+	}))
 
-	log.Println("Server running at http://localhost:8080")
-	http.ListenAndServe(":8080", mux)
+	server := &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      tracing.Middleware(logging.Middleware(mux)),
+		ReadTimeout:  cfg.ReadTimeout.Duration,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+		IdleTimeout:  cfg.IdleTimeout.Duration,
+	}
+	server.RegisterOnShutdown(handlers.CloseEventStreams)
+
+	serverErr := make(chan error, 2)
+	go func() {
+		slog.Info("Server running", "addr", cfg.ListenAddr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// Metrics get their own listener so they are never proxied to the public
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics.Handler())
+		metricsMux.Handle("/debug/traces", tracing.MemoryHandler())
+		metricsServer = &http.Server{
+			Addr:        cfg.MetricsAddr,
+			Handler:     metricsMux,
+			ReadTimeout: cfg.ReadTimeout.Duration,
+			IdleTimeout: cfg.IdleTimeout.Duration,
+		}
+		go func() {
+			slog.Info("Metrics running", "addr", cfg.MetricsAddr)
+			serverErr <- metricsServer.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err = <-serverErr:
+		slog.Error("Server failed", "err", err)
+	case <-ctx.Done():
+		stop()
+		slog.Info("Shutting down")
+	}
+
+	// Stop taking requests and let the ones in flight finish
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to drain requests", "err", err)
+	}
+	if metricsServer != nil {
+		metricsServer.Shutdown(shutdownCtx)
+	}
+
+	handlers.StopLinkPreviews()
+	database.StopBackups()
+	if err := database.Close(); err != nil {
+		slog.Error("Failed to close database", "err", err)
+	}
+	// Send the spans still waiting in the batch
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to flush traces", "err", err)
+	}
+	slog.Info("Shutdown complete")
+
+	if err != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,175 @@
+// Package metrics exposes Prometheus metrics for the server. They are served
+// on their own listener so /metrics never goes through nginx to the public.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Users count towards active sessions for this long after their last request
+const activeSessionWindow = 15 * time.Minute
+
+// Route label for requests that matched no route
+const unmatchedRoute = "unmatched"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "postpath_http_requests_total",
+		Help: "HTTP requests served, by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "postpath_http_request_duration_seconds",
+		Help:    "Time to serve HTTP requests, by route template and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "postpath_db_query_duration_seconds",
+		Help:    "Time spent in database calls made through the timeout helpers, by operation.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 5},
+	}, []string{"operation"})
+
+	renderDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "postpath_template_render_duration_seconds",
+		Help:    "Time to execute templates, by template name.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+	}, []string{"template"})
+
+	postsCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "postpath_posts_created_total",
+		Help: "Posts created, by kind (text, link or reply).",
+	}, []string{"kind"})
+
+	pagesCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "postpath_pages_created_total",
+		Help: "Pages created.",
+	})
+
+	eventSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "postpath_event_subscribers",
+		Help: "Open server-sent event streams.",
+	})
+
+	lastBackup = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "postpath_backup_last_success_timestamp_seconds",
+		Help: "When the last scheduled backup completed, as a Unix time.",
+	})
+
+	backupFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "postpath_backup_failures_total",
+		Help: "Scheduled backups that failed.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "postpath_active_sessions",
+		Help: "Signed-in users who made a request in the last 15 minutes.",
+	}, activeSessions)
+)
+
+// Last request time of each signed-in user. Sessions live in cookies, so
+// recent activity is the closest measure of who is signed in.
+var seen = struct {
+	sync.Mutex
+	users map[int]time.Time
+}{users: map[int]time.Time{}}
+
+// Serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Counts and times requests by the route template they matched, so paths
+// such as /page/1/5 and /page/1/7 share one series. It must be installed
+// with the router's Use so the matched route is known.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := unmatchedRoute
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		instrument(route, next).ServeHTTP(w, r)
+	})
+}
+
+// Counts and times requests that matched no route
+func NotFound(next http.Handler) http.Handler {
+	return instrument(unmatchedRoute, next)
+}
+
+func instrument(route string, next http.Handler) http.Handler {
+	labels := prometheus.Labels{"route": route}
+	return promhttp.InstrumentHandlerCounter(
+		requestsTotal.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(requestDuration.MustCurryWith(labels), next),
+	)
+}
+
+// Records how long a database call that started at start took
+func ObserveQuery(operation string, start time.Time) {
+	queryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// Records how long a template that started rendering at start took
+func ObserveRender(template string, start time.Time) {
+	renderDuration.WithLabelValues(template).Observe(time.Since(start).Seconds())
+}
+
+// Counts a new post of the given kind
+func PostCreated(kind string) {
+	postsCreated.WithLabelValues(kind).Inc()
+}
+
+func PageCreated() {
+	pagesCreated.Inc()
+}
+
+func SubscriberAdded() {
+	eventSubscribers.Inc()
+}
+
+func SubscriberRemoved() {
+	eventSubscribers.Dec()
+}
+
+// Records when the latest backup was taken
+func BackupCompleted(taken time.Time) {
+	lastBackup.Set(float64(taken.Unix()))
+}
+
+func BackupFailed() {
+	backupFailures.Inc()
+}
+
+// Notes a request from a signed-in user
+func UserSeen(userId int) {
+	if userId <= 0 {
+		return
+	}
+	seen.Lock()
+	seen.users[userId] = time.Now()
+	seen.Unlock()
+}
+
+// Counts recently active users, forgetting those who have gone quiet
+func activeSessions() float64 {
+	cutoff := time.Now().Add(-activeSessionWindow)
+
+	seen.Lock()
+	defer seen.Unlock()
+	for userId, last := range seen.users {
+		if last.Before(cutoff) {
+			delete(seen.users, userId)
+		}
+	}
+	return float64(len(seen.users))
+}
@@ -0,0 +1,51 @@
+// Package response captures what a handler wrote, for the middleware that
+// logs and traces requests.
+package response
+
+import "net/http"
+
+// Captures the status and size of a response. Unwrap keeps the wrapped
+// writer's optional interfaces, such as flushing and write deadlines for
+// event streams, reachable through http.ResponseController.
+type Recorder struct {
+	http.ResponseWriter
+	Status      int
+	Bytes       int
+	wroteHeader bool
+}
+
+// Wraps w in a Recorder. Middleware further in gets back the Recorder an
+// outer one installed, so a request is only ever wrapped once.
+func NewRecorder(w http.ResponseWriter) *Recorder {
+	if recorder, ok := w.(*Recorder); ok {
+		return recorder
+	}
+	return &Recorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (w *Recorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.Status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *Recorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.Bytes += n
+	return n, err
+}
+
+// Event streams check for http.Flusher directly
+func (w *Recorder) Flush() {
+	w.wroteHeader = true
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *Recorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"3f9a1c.jpg", true},
+		{"3f9a1c_thumb.jpg", true},
+		{"A-b.c", true},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{".hidden", false},
+		{"../etc/passwd", false},
+		{"a/../../etc/passwd", false},
+		{"a/b", false},
+		{"/etc/passwd", false},
+		{`..\windows`, false},
+		{`a\b`, false},
+		{"a b", false},
+		{"a\x00b", false},
+		{"a\n", false},
+		{"%2e%2e", false},
+		{"héllo.jpg", false},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			if got := ValidKey(test.key); got != test.valid {
+				t.Errorf("ValidKey(%q) = %v, want %v", test.key, got, test.valid)
+			}
+		})
+	}
+}
+
+func readObject(t *testing.T, store Storage, key string) string {
+	t.Helper()
+	r, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := store.Put(ctx, "a.jpg", strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, store, "a.jpg"); got != "first" {
+		t.Errorf("Get = %q, want first", got)
+	}
+	if err := store.Put(ctx, "a.jpg", strings.NewReader("second")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, store, "a.jpg"); got != "second" {
+		t.Errorf("Get after replacing = %q, want second", got)
+	}
+
+	// Only the stored object is left behind, no temporary files
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "a.jpg" {
+		t.Errorf("directory holds %v, want only a.jpg", entries)
+	}
+
+	if err := store.Delete(ctx, "a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "a.jpg"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: %v, want %v", err, ErrNotFound)
+	}
+	if err := store.Delete(ctx, "a.jpg"); err != nil {
+		t.Errorf("deleting a missing object: %v", err)
+	}
+}
+
+// Keys that could reach outside the store are refused before touching the
+// filesystem
+func TestLocalInvalidKeys(t *testing.T) {
+	parent := t.TempDir()
+	store, err := NewLocal(parent + "/uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(parent+"/secret", []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, key := range []string{"../secret", "..", "", "a/b"} {
+		if err := store.Put(ctx, key, strings.NewReader("x")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q): %v, want %v", key, err, ErrInvalidKey)
+		}
+		if _, err := store.Get(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Get(%q): %v, want %v", key, err, ErrInvalidKey)
+		}
+		if err := store.Delete(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Delete(%q): %v, want %v", key, err, ErrInvalidKey)
+		}
+	}
+	if _, err := os.Stat(parent + "/secret"); err != nil {
+		t.Errorf("file outside the store was touched: %v", err)
+	}
+}
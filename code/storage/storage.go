@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"regexp"
+)
+
+// ErrNotFound is returned when no object exists for a key
+var ErrNotFound = errors.New("storage: object not found")
+
+// ErrInvalidKey is returned for keys that could escape the store
+var ErrInvalidKey = errors.New("storage: invalid key")
+
+// Keys are flat names such as "3f9a1c.jpg", which keeps them safe to use as
+// file names locally and as object names in an S3-compatible bucket
+var keyPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Storage keeps uploaded files. The local filesystem implementation is used
+// today; an S3-compatible one can be swapped in behind the same interface.
+type Storage interface {
+	// Put stores the contents of r under key, replacing any existing object
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens the object stored under key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key. Missing objects are not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// ValidKey reports whether key can be used with a Storage
+func ValidKey(key string) bool {
+	return len(key) <= 128 && keyPattern.MatchString(key)
+}
@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Spans the memory exporter keeps; older ones are dropped
+const maxMemorySpans = 1000
+
+// Keeps the most recent spans so traces can be inspected without running
+// a collector
+type memoryExporter struct {
+	mu    sync.Mutex
+	max   int
+	spans []Span
+}
+
+// A finished span as served by MemoryHandler
+type Span struct {
+	Name         string         `json:"name"`
+	TraceID      string         `json:"trace_id"`
+	SpanID       string         `json:"span_id"`
+	ParentSpanID string         `json:"parent_span_id,omitempty"`
+	Start        time.Time      `json:"start"`
+	DurationMS   float64        `json:"duration_ms"`
+	Status       string         `json:"status"`
+	Attributes   map[string]any `json:"attributes,omitempty"`
+}
+
+func newMemoryExporter(max int) *memoryExporter {
+	return &memoryExporter{max: max}
+}
+
+func (e *memoryExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range spans {
+		span := Span{
+			Name:       s.Name(),
+			TraceID:    s.SpanContext().TraceID().String(),
+			SpanID:     s.SpanContext().SpanID().String(),
+			Start:      s.StartTime(),
+			DurationMS: float64(s.EndTime().Sub(s.StartTime()).Microseconds()) / 1000,
+			Status:     s.Status().Code.String(),
+			Attributes: map[string]any{},
+		}
+		if s.Parent().IsValid() {
+			span.ParentSpanID = s.Parent().SpanID().String()
+		}
+		for _, attr := range s.Attributes() {
+			span.Attributes[string(attr.Key)] = attr.Value.AsInterface()
+		}
+		e.spans = append(e.spans, span)
+	}
+	if excess := len(e.spans) - e.max; excess > 0 {
+		e.spans = append([]Span(nil), e.spans[excess:]...)
+	}
+	return nil
+}
+
+func (e *memoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Returns the kept spans, oldest first, optionally only those of one trace
+func (e *memoryExporter) Spans(traceID string) []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	spans := []Span{}
+	for _, span := range e.spans {
+		if traceID == "" || span.TraceID == traceID {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// Serves the spans kept by the memory exporter as JSON, filtered to one
+// trace with ?trace_id=. It responds 404 when another exporter is in use.
+func MemoryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if memory == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(memory.Spans(r.URL.Query().Get("trace_id")))
+	})
+}
@@ -0,0 +1,143 @@
+// Package tracing records OpenTelemetry traces of requests, database calls
+// and template rendering. Traces are off unless an exporter is configured:
+// "otlp" sends them to a collector over OTLP/HTTP, and "memory" keeps the
+// most recent spans in the process for local debugging.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"postpath/response"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters that can be configured
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterMemory = "memory"
+)
+
+const serviceName = "postpath"
+
+var tracer = otel.Tracer("postpath/http")
+
+// Spans kept by the memory exporter, if it is the one in use
+var memory *memoryExporter
+
+// Installs the global tracer provider for the given exporter. endpoint is
+// the collector's OTLP/HTTP URL, e.g. http://collector:4318; when empty the
+// standard OTEL_EXPORTER_OTLP_* variables apply. sampleRatio is the share of
+// new traces recorded; requests that arrive with a sampled parent are always
+// recorded. The returned function flushes and stops the provider.
+func Setup(ctx context.Context, exporter string, endpoint string, sampleRatio float64) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	var spanProcessor sdktrace.SpanProcessor
+	switch strings.ToLower(exporter) {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		client, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("otlp exporter: %w", err)
+		}
+		spanProcessor = sdktrace.NewBatchSpanProcessor(client)
+	case ExporterMemory:
+		memory = newMemoryExporter(maxMemorySpans)
+		spanProcessor = sdktrace.NewSimpleSpanProcessor(memory)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(spanProcessor),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Starts a span for each request, continuing any trace the caller sent in
+// a traceparent header. It wraps the whole router so the request log line
+// is written inside the span; RouteMiddleware later names the span after
+// the route that matched.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rw := response.NewRecorder(w)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rw.Status))
+		if rw.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rw.Status))
+		}
+	})
+}
+
+// Names the request's span after the route template it matched, e.g.
+// "GET /page/{path}", so spans group like the metrics do. It must be
+// installed with the router's Use so the matched route is known.
+func RouteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if current := mux.CurrentRoute(r); current != nil {
+			if route, err := current.GetPathTemplate(); err == nil {
+				span := trace.SpanFromContext(r.Context())
+				span.SetName(r.Method + " " + route)
+				span.SetAttributes(semconv.HTTPRoute(route))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Starts a span for executing a template
+func StartRender(ctx context.Context, template string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "render "+template,
+		trace.WithAttributes(attribute.String("template.name", template)),
+	)
+}
+
+// Returns the trace ID of the span in ctx, or "" when the request is not
+// being traced
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() || !spanContext.IsSampled() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
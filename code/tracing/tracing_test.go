@@ -0,0 +1,90 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"postpath/database"
+	"postpath/logging"
+	"postpath/tracing"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A request through the server's middleware to a handler that queries the
+// database leaves a server span named after its route with the query's
+// span below it
+func TestRequestSpans(t *testing.T) {
+	shutdown, err := tracing.Setup(context.Background(), tracing.ExporterMemory, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdown(context.Background()) })
+
+	database.InitDB(filepath.Join(t.TempDir(), "postpath.db"), 5*time.Second)
+	t.Cleanup(func() { database.Close() })
+
+	router := mux.NewRouter()
+	router.Use(tracing.RouteMiddleware)
+	router.HandleFunc("/page/{pageId}", func(w http.ResponseWriter, r *http.Request) {
+		var title string
+		row, cancel := database.QueryRowWithTimeout(r.Context(), `SELECT title FROM pages WHERE id = ?`, mux.Vars(r)["pageId"])
+		defer cancel()
+		if err := row.Scan(&title); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(title))
+	})
+
+	recorder := httptest.NewRecorder()
+	tracing.Middleware(logging.Middleware(router)).ServeHTTP(recorder, httptest.NewRequest("GET", "/page/0", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "Home" {
+		t.Fatalf("response %d %q, want 200 \"Home\"", recorder.Code, recorder.Body.String())
+	}
+
+	spansRecorder := httptest.NewRecorder()
+	tracing.MemoryHandler().ServeHTTP(spansRecorder, httptest.NewRequest("GET", "/debug/traces", nil))
+	var spans []tracing.Span
+	if err := json.NewDecoder(spansRecorder.Body).Decode(&spans); err != nil {
+		t.Fatal(err)
+	}
+
+	var server, query *tracing.Span
+	for i := range spans {
+		switch spans[i].Name {
+		case "GET /page/{pageId}":
+			server = &spans[i]
+		case "SELECT pages":
+			query = &spans[i]
+		}
+	}
+	if server == nil || query == nil {
+		t.Fatalf("spans %+v, want a server span and a SELECT pages span", spans)
+	}
+
+	if route := server.Attributes["http.route"]; route != "/page/{pageId}" {
+		t.Errorf("server span route %v, want /page/{pageId}", route)
+	}
+	if status := server.Attributes["http.response.status_code"]; status != float64(http.StatusOK) {
+		t.Errorf("server span status %v, want 200", status)
+	}
+	if server.ParentSpanID != "" {
+		t.Errorf("server span has parent %s, want a root span", server.ParentSpanID)
+	}
+
+	if query.TraceID != server.TraceID || query.ParentSpanID != server.SpanID {
+		t.Errorf("query span is not a child of the server span")
+	}
+	if system := query.Attributes["db.system"]; system != "sqlite" {
+		t.Errorf("query span db.system %v, want sqlite", system)
+	}
+	// Arguments stay out of traces; only the statement text is recorded
+	if text := query.Attributes["db.query.text"]; text != "SELECT title FROM pages WHERE id = ?" {
+		t.Errorf("query span text %q", text)
+	}
+}